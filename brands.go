@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/joyent/triton-go/compute"
+)
+
+// instance brands, with "zone" standing for both joyent and lx zones
+const (
+	brandKVM   = "kvm"
+	brandBhyve = "bhyve"
+	brandZone  = "zone"
+)
+
+var packageNameTokens = regexp.MustCompile(`[-_.]`)
+
+// hostBrands are the brands docker-machine can provision: its provisioners
+// run on the docker-machine side and expect a full Linux VM, so LX and SmartOS
+// zones cannot be made into Docker hosts
+var hostBrands = []string{brandKVM, brandBhyve}
+
+func checkBrand(brand string) error {
+	switch brand {
+	case "", brandKVM, brandBhyve:
+		return nil
+	case "lx", "joyent", "joyent-minimal", brandZone:
+		return fmt.Errorf("%s driver cannot create %s-branded hosts: docker-machine provisions hosts as full Linux VMs, so use --%sbrand %s",
+			driverName, brand, flagPrefix, strings.Join(hostBrands, " or "))
+	}
+	return fmt.Errorf("invalid --%sbrand %q, expected %s", flagPrefix, brand, strings.Join(hostBrands, " or "))
+}
+
+// packageBrand returns the brand a package provisions, and whether CloudAPI
+// reported it. Older CloudAPIs do not, so the brand is then inferred from the
+// name: hardware VM packages are conventionally named after their hypervisor
+// ("k4-highcpu-kvm-1.75G", "b1-standard-bhyve-4G") and everything else is
+// taken for a zone package. Private clouds need not follow that convention,
+// so an inferred brand is only a guess.
+func packageBrand(pkg *tritonPackage) (string, bool) {
+	if pkg.Brand != "" {
+		return normalizeBrand(pkg.Brand), true
+	}
+
+	for _, token := range packageNameTokens.Split(strings.ToLower(pkg.Name), -1) {
+		switch token {
+		case brandKVM:
+			return brandKVM, false
+		case brandBhyve:
+			return brandBhyve, false
+		}
+	}
+	return brandZone, false
+}
+
+// normalizeBrand maps the zone brands onto brandZone
+func normalizeBrand(brand string) string {
+	switch brand {
+	case "joyent", "joyent-minimal", "lx":
+		return brandZone
+	}
+	return brand
+}
+
+// imageBrands lists the brands able to run an image, or nil if any can
+func imageBrands(image *compute.Image) []string {
+	if brand, ok := image.Requirements["brand"].(string); ok && brand != "" {
+		return []string{normalizeBrand(brand)}
+	}
+
+	switch image.Type {
+	case "zvol":
+		return []string{brandKVM, brandBhyve}
+	case "zone-dataset", "lx-dataset":
+		return []string{brandZone}
+	}
+	return nil
+}
+
+// checkImage rejects images docker-machine cannot provision regardless of
+// package, and warns about ones that are on their way out
+func checkImage(image *compute.Image) error {
+	switch image.Type {
+	case "docker":
+		return fmt.Errorf("image %s@%s (%s) is a Docker image for sdc-docker, not a VM image", image.Name, image.Version, image.ID)
+	case "zone-dataset", "lx-dataset":
+		return fmt.Errorf("image %s@%s (%s) is a %s image for zones, but docker-machine can only provision hardware VM (zvol) images",
+			image.Name, image.Version, image.ID, image.Type)
+	}
+	switch image.OS {
+	case "smartos", "illumos", "windows", "bsd":
+		return fmt.Errorf("image %s@%s (%s) runs %s, but docker-machine can only provision Linux hosts", image.Name, image.Version, image.ID, image.OS)
+	}
+	if image.State != "" && image.State != "active" {
+		log.Warnf("image %s@%s (%s) is %s; consider a newer image", image.Name, image.Version, image.ID, image.State)
+	}
+	return nil
+}
+
+// checkCompatible reports why pkg cannot run image, if it cannot. Only a
+// brand CloudAPI reported for the package counts; see checkBrandGuess.
+func checkCompatible(image *compute.Image, pkg *tritonPackage) error {
+	if brand, known := packageBrand(pkg); known {
+		if brands := imageBrands(image); brands != nil && !containsBrand(brands, brand) {
+			return fmt.Errorf("image %s@%s (%s) needs a %s package, but %q is a %s package",
+				image.Name, image.Version, image.Type, strings.Join(brands, " or "), pkg.Name, brand)
+		}
+	}
+
+	if minRAM, ok := image.Requirements["min_ram"].(float64); ok && pkg.Memory < int64(minRAM) {
+		return fmt.Errorf("image %s@%s needs at least %d MiB of memory, but package %q has %d MiB",
+			image.Name, image.Version, int64(minRAM), pkg.Name, pkg.Memory)
+	}
+	if maxRAM, ok := image.Requirements["max_ram"].(float64); ok && pkg.Memory > int64(maxRAM) {
+		return fmt.Errorf("image %s@%s supports at most %d MiB of memory, but package %q has %d MiB",
+			image.Name, image.Version, int64(maxRAM), pkg.Name, pkg.Memory)
+	}
+
+	return nil
+}
+
+// checkBrandGuess reports when the brand guessed from the name of a package
+// CloudAPI did not report a brand for suggests it cannot run image. The guess
+// may well be wrong, so this is only ever a warning.
+func checkBrandGuess(image *compute.Image, pkg *tritonPackage) error {
+	brand, known := packageBrand(pkg)
+	if known {
+		return nil
+	}
+	if brands := imageBrands(image); brands != nil && !containsBrand(brands, brand) {
+		return fmt.Errorf("image %s@%s (%s) needs a %s package, but %q looks like a %s package",
+			image.Name, image.Version, image.Type, strings.Join(brands, " or "), pkg.Name, brand)
+	}
+	return nil
+}
+
+func containsBrand(brands []string, brand string) bool {
+	for _, b := range brands {
+		if b == brand {
+			return true
+		}
+	}
+	return false
+}
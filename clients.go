@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/joyent/triton-go"
+	"github.com/joyent/triton-go/account"
+	"github.com/joyent/triton-go/compute"
+	"github.com/joyent/triton-go/network"
+)
+
+// authConfig is the part of the driver configuration the cached CloudAPI
+// clients were built from; a change to any of it means a new signer and
+// transport
+type authConfig struct {
+	url        string
+	account    string
+	keyId      string
+	keyPath    string
+	passphrase string
+	caCert     string
+	insecure   bool
+}
+
+// apiClients caches the signer and CloudAPI clients for the lifetime of the
+// plugin process, so that repeated GetState/GetIP calls neither re-read the
+// key nor reconnect to the SSH agent and CloudAPI
+type apiClients struct {
+	auth      authConfig
+	config    *triton.ClientConfig
+	transport *http.Transport
+
+	compute *compute.ComputeClient
+	network *network.NetworkClient
+	account *account.AccountClient
+}
+
+func (d *Driver) authConfig() authConfig {
+	return authConfig{
+		url:        d.TritonUrl,
+		account:    d.TritonAccount,
+		keyId:      d.TritonKeyId,
+		keyPath:    d.TritonKeyPath,
+		passphrase: d.TritonKeyPassphrase,
+		caCert:     d.TritonCACert,
+		insecure:   d.TritonInsecure,
+	}
+}
+
+// apiClients returns the cached clients, starting afresh when the auth config
+// has changed since they were built
+func (d *Driver) apiClients() (*apiClients, error) {
+	if d.clients != nil && d.clients.auth == d.authConfig() {
+		return d.clients, nil
+	}
+
+	tlsConfig, err := d.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := newTransport(tlsConfig)
+
+	config, err := d.clientConfig(transport)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.clients != nil {
+		d.clients.transport.CloseIdleConnections()
+	}
+	// clientConfig fills in the key ID and passphrase, so compare against
+	// the config as it is now
+	d.clients = &apiClients{
+		auth:      d.authConfig(),
+		config:    config,
+		transport: transport,
+	}
+	return d.clients, nil
+}
+
+// newTransport is triton-go's transport with keep-alives enabled, so that the
+// compute, network and account clients share connections to CloudAPI
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSClientConfig:     tlsConfig,
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// Each benchmark has an uncached twin that drops the clients before every
+// call, as the driver did before it cached them, so the two can be compared
+
+func BenchmarkClient(b *testing.B) {
+	benchmarkClient(b, true)
+}
+
+func BenchmarkClientUncached(b *testing.B) {
+	benchmarkClient(b, false)
+}
+
+func benchmarkClient(b *testing.B, cached bool) {
+	api := newFakeCloudAPI(b)
+	d := newTestDriver(b, api, nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !cached {
+			d.clients = nil
+		}
+		if _, err := d.client(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetState(b *testing.B) {
+	benchmarkGetState(b, true)
+}
+
+func BenchmarkGetStateUncached(b *testing.B) {
+	benchmarkGetState(b, false)
+}
+
+func benchmarkGetState(b *testing.B, cached bool) {
+	api := newFakeCloudAPI(b)
+	d := newTestDriver(b, api, nil)
+	d.TritonMachineId = api.addMachine("test-machine", nil).ID
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !cached && d.clients != nil {
+			d.clients.transport.CloseIdleConnections()
+			d.clients = nil
+		}
+		if _, err := d.GetState(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestClientCache(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	other := newFakeCloudAPI(t)
+	d := newTestDriver(t, api, nil)
+
+	tlsServer := httptest.NewTLSServer(nil)
+	defer tlsServer.Close()
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	if err := ioutil.WriteFile(caCert, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func()
+		reused bool
+	}{
+		{name: "unchanged", change: func() {}, reused: true},
+		{name: "url", change: func() { d.TritonUrl = other.URL }},
+		{name: "account", change: func() { d.TritonAccount = "other" }},
+		{name: "key", change: func() {
+			d.TritonKeyPath, _ = writeTestKey(t, api, t.TempDir())
+			d.TritonKeyId = ""
+		}},
+		{name: "ca cert", change: func() { d.TritonCACert = caCert }},
+		{name: "insecure", change: func() { d.TritonInsecure = true }},
+	}
+
+	for _, test := range tests {
+		before, err := d.client()
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport := d.clients.transport
+
+		test.change()
+		after, err := d.client()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if reused := after == before; reused != test.reused {
+			t.Errorf("%s: client reused = %t, want %t", test.name, reused, test.reused)
+		}
+		if reused := d.clients.transport == transport; reused != test.reused {
+			t.Errorf("%s: transport reused = %t, want %t", test.name, reused, test.reused)
+		}
+		if after.Client.TritonURL.String() != d.TritonUrl {
+			t.Errorf("%s: client uses %s, want %s", test.name, after.Client.TritonURL.String(), d.TritonUrl)
+		}
+	}
+
+	if d.clients.transport.TLSClientConfig.RootCAs == nil || !d.clients.transport.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("transport does not use the CA and insecure settings")
+	}
+}
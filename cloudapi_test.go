@@ -0,0 +1,669 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/joyent/triton-go/compute"
+	"github.com/joyent/triton-go/network"
+)
+
+// fakeCloudAPI is an in-process CloudAPI serving one account. It checks
+// request signatures and moves instances through their states on a timer,
+// so the driver can be exercised end to end without a Triton deployment.
+type fakeCloudAPI struct {
+	*httptest.Server
+
+	account    string
+	accountID  string
+	cnsEnabled bool
+
+	// how long provisioning, starting, stopping and deleting take
+	transition time.Duration
+	// state a new instance ends up in once provisioning is over
+	provisionResult string
+	// how long after provisioning a new instance gets its IP
+	ipDelay time.Duration
+
+	mu        sync.Mutex
+	intercept func(w http.ResponseWriter, r *http.Request) bool
+	keys      map[string]crypto.PublicKey
+	images    []*compute.Image
+	packages  []*fakePackage
+	networks  []*network.Network
+	machines  map[string]*fakeMachine
+	fwrules   map[string]*network.FirewallRule
+	requests  []string
+	lastID    int
+}
+
+// fakePackage is a package as CloudAPI lists it, including the brand
+// compute.Package leaves out
+type fakePackage struct {
+	compute.Package
+	Brand string `json:"brand,omitempty"`
+}
+
+type fakeMachine struct {
+	ID              string                 `json:"id"`
+	Name            string                 `json:"name"`
+	Type            string                 `json:"type"`
+	Brand           string                 `json:"brand"`
+	State           string                 `json:"state"`
+	Image           string                 `json:"image"`
+	Package         string                 `json:"package"`
+	Memory          int64                  `json:"memory"`
+	Disk            int64                  `json:"disk"`
+	Metadata        map[string]string      `json:"metadata"`
+	Tags            map[string]interface{} `json:"tags"`
+	Created         time.Time              `json:"created"`
+	Updated         time.Time              `json:"updated"`
+	IPs             []string               `json:"ips"`
+	Networks        []string               `json:"networks"`
+	PrimaryIP       string                 `json:"primaryIp"`
+	FirewallEnabled bool                   `json:"firewall_enabled"`
+	ComputeNode     string                 `json:"compute_node"`
+	DomainNames     []string               `json:"dns_names,omitempty"`
+
+	// body of the create request
+	input map[string]interface{}
+	// state changes still to come
+	pending []stateChange
+	// IP assigned once a stateChange with ip set comes due
+	ip string
+}
+
+// stateChange moves an instance to state at the given time; an empty state
+// leaves it unchanged, and ip hands out the instance's address
+type stateChange struct {
+	at    time.Time
+	state string
+	ip    bool
+}
+
+func (m *fakeMachine) settle(now time.Time) {
+	for len(m.pending) > 0 && !m.pending[0].at.After(now) {
+		change := m.pending[0]
+		m.pending = m.pending[1:]
+		if change.state != "" {
+			m.State = change.state
+		}
+		if change.ip {
+			m.IPs = []string{m.ip}
+			m.PrimaryIP = m.ip
+		}
+		m.Updated = change.at
+	}
+}
+
+func (m *fakeMachine) schedule(changes ...stateChange) {
+	m.pending = changes
+	m.Updated = time.Now()
+}
+
+const fakeImageID = "8b9ba1e4-4f73-11e8-bd8c-6b5b2c0d2bd7"
+
+// newFakeCloudAPI starts a fake with an Ubuntu KVM image, a zone image,
+// KVM, bhyve and zone packages and a public and a private network
+func newFakeCloudAPI(t testing.TB) *fakeCloudAPI {
+	api := &fakeCloudAPI{
+		account:         "test",
+		accountID:       "4c1f0fa1-5e5b-4c7f-9d8e-0b83e11f1ee0",
+		cnsEnabled:      true,
+		transition:      30 * time.Millisecond,
+		provisionResult: "running",
+		keys:            map[string]crypto.PublicKey{},
+		machines:        map[string]*fakeMachine{},
+		fwrules:         map[string]*network.FirewallRule{},
+		images: []*compute.Image{
+			{
+				ID:           fakeImageID,
+				Name:         "ubuntu-certified-16.04",
+				Version:      "20180222",
+				OS:           "linux",
+				Type:         "zvol",
+				State:        "active",
+				Public:       true,
+				Requirements: map[string]interface{}{"min_ram": float64(1024)},
+				PublishedAt:  time.Date(2018, 2, 22, 0, 0, 0, 0, time.UTC),
+			},
+			{
+				ID:          "1f32508c-e6e9-11e6-bd8f-a38f5bc3b3ef",
+				Name:        "base-64-lts",
+				Version:     "16.4.1",
+				OS:          "smartos",
+				Type:        "zone-dataset",
+				State:       "active",
+				Public:      true,
+				PublishedAt: time.Date(2017, 2, 1, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		packages: []*fakePackage{
+			{Package: compute.Package{ID: "c2d5b5d8-a2a1-11e7-a2e9-f7e1e33de8c4", Name: "k4-highcpu-kvm-250M", Memory: 256, Disk: 15360, VCPUs: 1, Group: "Compute"}, Brand: "kvm"},
+			{Package: compute.Package{ID: "14ad9d54-d0b8-11e7-9a3c-1f3e9a4b5f60", Name: "k4-highcpu-kvm-1.75G", Memory: 1792, Disk: 51200, VCPUs: 1, Group: "Compute"}, Brand: "kvm"},
+			{Package: compute.Package{ID: "3ef5e4a2-4f74-11e8-8a2e-5b7e5e1f7ce0", Name: "b1-standard-bhyve-4G", Memory: 4096, Disk: 102400, VCPUs: 2, Group: "Standard"}, Brand: "bhyve"},
+			{Package: compute.Package{ID: "6b9c7e2c-4f74-11e8-9ac2-0b3a3e5b5f81", Name: "g4-highcpu-1G", Memory: 1024, Disk: 25600, VCPUs: 1, Group: "Compute"}, Brand: "joyent"},
+		},
+		networks: []*network.Network{
+			{Id: "9ec60129-9034-47b4-b111-3026f9b1a10f", Name: "Joyent-SDC-Public", Public: true},
+			{Id: "5983940e-58a5-4543-b732-c689b1fe4c08", Name: "My-Fabric-Network", Fabric: true, Subnet: "192.168.128.0/22"},
+		},
+	}
+	api.Server = httptest.NewServer(http.HandlerFunc(api.serveHTTP))
+	t.Cleanup(api.Close)
+	return api
+}
+
+// addKey registers a public key with the account and returns the MD5
+// fingerprint requests are signed with
+func (api *fakeCloudAPI) addKey(t testing.TB, key crypto.PublicKey) string {
+	sshKey, err := ssh.NewPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := ssh.FingerprintLegacyMD5(sshKey)
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.keys[fingerprint] = key
+	return fingerprint
+}
+
+// setIntercept installs a handler that sees every request first and takes
+// it over by returning true
+func (api *fakeCloudAPI) setIntercept(intercept func(w http.ResponseWriter, r *http.Request) bool) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.intercept = intercept
+}
+
+// requestLog returns the "METHOD path" of every request served so far
+func (api *fakeCloudAPI) requestLog() []string {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return append([]string(nil), api.requests...)
+}
+
+// machine returns a snapshot of an instance, as CloudAPI would report it now
+func (api *fakeCloudAPI) machine(id string) *fakeMachine {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	m, ok := api.machines[id]
+	if !ok {
+		return nil
+	}
+	m.settle(time.Now())
+	snapshot := *m
+	return &snapshot
+}
+
+// addMachine adds an instance created outside the driver
+func (api *fakeCloudAPI) addMachine(name string, tags map[string]interface{}) *fakeMachine {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	now := time.Now()
+	m := &fakeMachine{
+		ID:      api.newID(),
+		Name:    name,
+		Type:    "virtualmachine",
+		Brand:   "kvm",
+		State:   "running",
+		Image:   fakeImageID,
+		Tags:    tags,
+		Created: now,
+		Updated: now,
+	}
+	api.machines[m.ID] = m
+	return m
+}
+
+func (api *fakeCloudAPI) newID() string {
+	api.lastID++
+	return fmt.Sprintf("%08x-0000-4000-8000-%012x", api.lastID, api.lastID)
+}
+
+func (api *fakeCloudAPI) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	api.requests = append(api.requests, r.Method+" "+r.URL.Path)
+	intercept := api.intercept
+	api.mu.Unlock()
+
+	if intercept != nil && intercept(w, r) {
+		return
+	}
+
+	if r.URL.Path == "/--ping" {
+		writeJSON(w, http.StatusOK, compute.PingOutput{
+			Ping:     "pong",
+			CloudAPI: compute.CloudAPI{Versions: []string{"8.0.0"}},
+		})
+		return
+	}
+
+	if err := api.checkSignature(r); err != nil {
+		writeError(w, http.StatusUnauthorized, "InvalidCredentials", err.Error())
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != api.account {
+		writeError(w, http.StatusForbidden, "NotAuthorized", "you do not have permission to access "+r.URL.Path)
+		return
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":                 api.accountID,
+			"login":              api.account,
+			"triton_cns_enabled": api.cnsEnabled,
+		})
+	case len(parts) == 2 && parts[1] == "keys" && r.Method == http.MethodGet:
+		api.listKeys(w)
+	case len(parts) == 2 && parts[1] == "datacenters":
+		writeJSON(w, http.StatusOK, map[string]string{"test-1": api.URL})
+	case len(parts) == 2 && parts[1] == "images":
+		api.listImages(w, r)
+	case len(parts) == 3 && parts[1] == "images":
+		for _, image := range api.images {
+			if image.ID == parts[2] {
+				writeJSON(w, http.StatusOK, image)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "ResourceNotFound", "image not found")
+	case len(parts) == 2 && parts[1] == "packages":
+		writeJSON(w, http.StatusOK, api.packages)
+	case len(parts) == 3 && parts[1] == "packages":
+		for _, pkg := range api.packages {
+			if pkg.ID == parts[2] || pkg.Name == parts[2] {
+				writeJSON(w, http.StatusOK, pkg)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "ResourceNotFound", "package not found")
+	case len(parts) == 2 && parts[1] == "networks":
+		writeJSON(w, http.StatusOK, api.networks)
+	case len(parts) == 2 && parts[1] == "machines" && r.Method == http.MethodGet:
+		api.listMachines(w, r)
+	case len(parts) == 2 && parts[1] == "machines" && r.Method == http.MethodPost:
+		api.createMachine(w, r)
+	case len(parts) >= 3 && parts[1] == "machines":
+		api.serveMachine(w, r, parts[2], parts[3:])
+	case len(parts) == 2 && parts[1] == "fwrules":
+		api.serveFirewallRules(w, r)
+	case len(parts) == 3 && parts[1] == "fwrules":
+		api.serveFirewallRule(w, r, parts[2])
+	default:
+		writeError(w, http.StatusNotFound, "ResourceNotFound", r.Method+" "+r.URL.Path+" does not exist")
+	}
+}
+
+var signatureParams = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// checkSignature verifies the HTTP signature of the date header, the way
+// CloudAPI authenticates every request
+func (api *fakeCloudAPI) checkSignature(r *http.Request) error {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Signature ") {
+		return fmt.Errorf("missing signature")
+	}
+	params := map[string]string{}
+	for _, m := range signatureParams.FindAllStringSubmatch(authorization, -1) {
+		params[m[1]] = m[2]
+	}
+	if params["headers"] != "date" {
+		return fmt.Errorf("signature must cover the date header, not %q", params["headers"])
+	}
+
+	date, err := time.Parse(time.RFC1123, r.Header.Get("Date"))
+	if err != nil {
+		return fmt.Errorf("invalid date header: %s", err)
+	}
+	if skew := time.Since(date); skew > 5*time.Minute || skew < -5*time.Minute {
+		return fmt.Errorf("clock skew of %s", skew)
+	}
+
+	keyId := strings.SplitN(strings.TrimPrefix(params["keyId"], "/"), "/keys/", 2)
+	if len(keyId) != 2 || keyId[0] != api.account {
+		return fmt.Errorf("invalid keyId %q", params["keyId"])
+	}
+	api.mu.Lock()
+	key, ok := api.keys[keyId[1]]
+	api.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown key %s", keyId[1])
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %s", err)
+	}
+	if !verifySignature(key, params["algorithm"], []byte("date: "+r.Header.Get("Date")), signature) {
+		return fmt.Errorf("invalid %s signature", params["algorithm"])
+	}
+	return nil
+}
+
+func verifySignature(key crypto.PublicKey, algorithm string, message, signature []byte) bool {
+	var hash crypto.Hash
+	switch {
+	case strings.HasSuffix(algorithm, "-sha1"):
+		hash = crypto.SHA1
+	case strings.HasSuffix(algorithm, "-sha256"):
+		hash = crypto.SHA256
+	case strings.HasSuffix(algorithm, "-sha384"):
+		hash = crypto.SHA384
+	case strings.HasSuffix(algorithm, "-sha512"):
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+	h := hash.New()
+	h.Write(message)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(algorithm, "rsa-") && rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		return strings.HasPrefix(algorithm, "ecdsa-") && ecdsa.VerifyASN1(k, digest, signature)
+	case ed25519.PublicKey:
+		return algorithm == "ed25519-sha512" && ed25519.Verify(k, message, signature)
+	}
+	return false
+}
+
+func (api *fakeCloudAPI) listKeys(w http.ResponseWriter) {
+	keys := []map[string]string{}
+	for fingerprint, key := range api.keys {
+		sshKey, err := ssh.NewPublicKey(key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+		keys = append(keys, map[string]string{
+			"name":        fingerprint,
+			"fingerprint": fingerprint,
+			"key":         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshKey))),
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i]["name"] < keys[j]["name"] })
+	writeJSON(w, http.StatusOK, keys)
+}
+
+func (api *fakeCloudAPI) listImages(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	images := []*compute.Image{}
+	for _, image := range api.images {
+		switch {
+		case query.Get("name") != "" && image.Name != query.Get("name"),
+			query.Get("version") != "" && image.Version != query.Get("version"),
+			query.Get("os") != "" && image.OS != query.Get("os"),
+			query.Get("type") != "" && image.Type != query.Get("type"),
+			query.Get("owner") != "" && image.Owner != query.Get("owner"),
+			query.Get("state") == "" && image.State != "active",
+			query.Get("state") != "" && query.Get("state") != "all" && image.State != query.Get("state"):
+			continue
+		}
+		images = append(images, image)
+	}
+	writeJSON(w, http.StatusOK, images)
+}
+
+func (api *fakeCloudAPI) listMachines(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	machines := []*fakeMachine{}
+	for _, m := range api.machines {
+		m.settle(now)
+		if m.State == "deleted" {
+			continue
+		}
+		if name := r.URL.Query().Get("name"); name != "" && m.Name != name {
+			continue
+		}
+		machines = append(machines, m)
+	}
+	sort.Slice(machines, func(i, j int) bool { return machines[i].ID < machines[j].ID })
+	writeJSON(w, http.StatusOK, machines)
+}
+
+func (api *fakeCloudAPI) createMachine(w http.ResponseWriter, r *http.Request) {
+	var input map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+
+	name, _ := input["name"].(string)
+	for _, m := range api.machines {
+		if m.Name == name && m.State != "deleted" {
+			writeError(w, http.StatusConflict, "InvalidArgument", fmt.Sprintf("name %q is already in use", name))
+			return
+		}
+	}
+
+	var image *compute.Image
+	for _, i := range api.images {
+		if i.ID == input["image"] {
+			image = i
+		}
+	}
+	if image == nil {
+		writeError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("image %v not found", input["image"]))
+		return
+	}
+	var pkg *fakePackage
+	for _, p := range api.packages {
+		if p.ID == input["package"] || p.Name == input["package"] {
+			pkg = p
+		}
+	}
+	if pkg == nil {
+		writeError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("package %v not found", input["package"]))
+		return
+	}
+
+	now := time.Now()
+	m := &fakeMachine{
+		ID:              api.newID(),
+		Name:            name,
+		Type:            "virtualmachine",
+		Brand:           pkg.Brand,
+		State:           "provisioning",
+		Image:           image.ID,
+		Package:         pkg.Name,
+		Memory:          pkg.Memory,
+		Disk:            pkg.Disk,
+		Metadata:        map[string]string{},
+		Tags:            map[string]interface{}{},
+		Created:         now,
+		Updated:         now,
+		IPs:             []string{},
+		Networks:        []string{api.networks[0].Id},
+		FirewallEnabled: input["firewall_enabled"] == true,
+		ComputeNode:     "44454c4c-5400-1034-8053-b5c04f383432",
+		input:           input,
+	}
+	if name == "" {
+		m.Name = m.ID[:8]
+	}
+	if api.cnsEnabled {
+		for _, label := range []string{m.Name, m.ID} {
+			m.DomainNames = append(m.DomainNames, label+".inst."+api.accountID+".test-1.cns.example.com")
+		}
+	}
+	for key, value := range input {
+		if strings.HasPrefix(key, "tag.") {
+			m.Tags[strings.TrimPrefix(key, "tag.")] = value
+		}
+		if strings.HasPrefix(key, "metadata.") {
+			m.Metadata[strings.TrimPrefix(key, "metadata.")] = fmt.Sprint(value)
+		}
+	}
+	m.ip = fmt.Sprintf("198.51.100.%d", api.lastID)
+
+	provisioned := now.Add(api.transition)
+	if api.provisionResult == "running" {
+		m.pending = []stateChange{
+			{at: provisioned, state: "running", ip: api.ipDelay == 0},
+		}
+		if api.ipDelay > 0 {
+			m.pending = append(m.pending, stateChange{at: provisioned.Add(api.ipDelay), ip: true})
+		}
+	} else {
+		m.pending = []stateChange{{at: provisioned, state: api.provisionResult}}
+	}
+	api.machines[m.ID] = m
+
+	writeJSON(w, http.StatusCreated, m)
+}
+
+func (api *fakeCloudAPI) serveMachine(w http.ResponseWriter, r *http.Request, id string, sub []string) {
+	m, ok := api.machines[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ResourceNotFound", "machine "+id+" not found")
+		return
+	}
+	now := time.Now()
+	m.settle(now)
+	if m.State == "deleted" {
+		writeError(w, http.StatusGone, "ResourceNotFound", "machine "+id+" was deleted")
+		return
+	}
+
+	switch {
+	case len(sub) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, m)
+	case len(sub) == 0 && r.Method == http.MethodDelete:
+		m.State = "stopping"
+		m.schedule(stateChange{at: now.Add(api.transition), state: "deleted"})
+		w.WriteHeader(http.StatusNoContent)
+	case len(sub) == 0 && r.Method == http.MethodPost:
+		api.machineAction(w, r, m, now)
+	case len(sub) == 1 && sub[0] == "tags" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, m.Tags)
+	case len(sub) == 1 && sub[0] == "tags" && (r.Method == http.MethodPost || r.Method == http.MethodPut):
+		var tags map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&tags); err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+			return
+		}
+		if r.Method == http.MethodPut {
+			m.Tags = map[string]interface{}{}
+		}
+		for key, value := range tags {
+			m.Tags[key] = value
+		}
+		m.Updated = now
+		writeJSON(w, http.StatusOK, m.Tags)
+	case len(sub) == 1 && sub[0] == "nics" && r.Method == http.MethodGet:
+		nics := []*compute.NIC{}
+		if m.PrimaryIP != "" {
+			nics = append(nics, &compute.NIC{IP: m.PrimaryIP, Primary: true, State: "running", Network: m.Networks[0]})
+		}
+		writeJSON(w, http.StatusOK, nics)
+	default:
+		writeError(w, http.StatusNotFound, "ResourceNotFound", r.Method+" "+r.URL.Path+" does not exist")
+	}
+}
+
+func (api *fakeCloudAPI) machineAction(w http.ResponseWriter, r *http.Request, m *fakeMachine, now time.Time) {
+	switch action := r.URL.Query().Get("action"); action {
+	case "start":
+		if m.State == "stopped" {
+			m.schedule(stateChange{at: now.Add(api.transition), state: "running"})
+		}
+	case "stop":
+		if m.State == "running" {
+			m.State = "stopping"
+			m.schedule(stateChange{at: now.Add(api.transition), state: "stopped"})
+		}
+	case "reboot":
+		if m.State != "running" {
+			writeError(w, http.StatusConflict, "InvalidState", "machine "+m.ID+" is "+m.State)
+			return
+		}
+		m.schedule(
+			stateChange{at: now.Add(api.transition), state: "stopped"},
+			stateChange{at: now.Add(2 * api.transition), state: "running"},
+		)
+	default:
+		writeError(w, http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("unknown action %q", action))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (api *fakeCloudAPI) serveFirewallRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rules := []*network.FirewallRule{}
+		for _, rule := range api.fwrules {
+			rules = append(rules, rule)
+		}
+		sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+		writeJSON(w, http.StatusOK, rules)
+	case http.MethodPost:
+		var input network.CreateRuleInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input.Rule == "" {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", "a rule is required")
+			return
+		}
+		rule := &network.FirewallRule{
+			ID:          api.newID(),
+			Enabled:     input.Enabled,
+			Rule:        input.Rule,
+			Description: input.Description,
+		}
+		api.fwrules[rule.ID] = rule
+		writeJSON(w, http.StatusCreated, rule)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "BadMethod", r.Method+" is not allowed")
+	}
+}
+
+func (api *fakeCloudAPI) serveFirewallRule(w http.ResponseWriter, r *http.Request, id string) {
+	rule, ok := api.fwrules[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ResourceNotFound", "firewall rule "+id+" not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, rule)
+	case http.MethodDelete:
+		delete(api.fwrules, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "BadMethod", r.Method+" is not allowed")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]string{"code": code, "message": message})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/joyent/triton-go/compute"
+)
+
+// lookupHost resolves CNS names
+var lookupHost = net.LookupHost
+
+// CNS service names become DNS labels
+var cnsServicePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+func checkCNSServices(services []string) error {
+	for _, service := range services {
+		if !cnsServicePattern.MatchString(service) {
+			return fmt.Errorf("invalid CNS service name %q: use lowercase letters, digits and dashes", service)
+		}
+	}
+	return nil
+}
+
+// cnsHostname picks the instance's CNS name that currently resolves to ip,
+// preferring the "<name>.inst." record over the "<uuid>.inst." one. It
+// returns "" when no name resolves yet, e.g. while CNS catches up with a new
+// instance.
+func cnsHostname(machine *compute.Instance, ip string) string {
+	var byName, byID []string
+	for _, name := range machine.DomainNames {
+		switch {
+		case strings.HasPrefix(name, machine.Name+".inst."):
+			byName = append(byName, name)
+		case strings.HasPrefix(name, machine.ID+".inst."):
+			byID = append(byID, name)
+		}
+	}
+
+	for _, name := range append(byName, byID...) {
+		addrs, err := lookupHost(name)
+		if err != nil {
+			log.Debugf("CNS name %s does not resolve yet: %s", name, err)
+			continue
+		}
+		for _, addr := range addrs {
+			if addr == ip {
+				return name
+			}
+		}
+		log.Debugf("CNS name %s resolves to %v, not %s", name, addrs, ip)
+	}
+
+	return ""
+}
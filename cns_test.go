@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/machine/libmachine/state"
+)
+
+// fakeDNS resolves the CNS names of api's instances to their primary IPs,
+// counting lookups
+type fakeDNS struct {
+	api *fakeCloudAPI
+
+	mu      sync.Mutex
+	lookups int
+	failing bool
+}
+
+func (dns *fakeDNS) lookupHost(host string) ([]string, error) {
+	dns.mu.Lock()
+	dns.lookups++
+	failing := dns.failing
+	dns.mu.Unlock()
+
+	notFound := &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	if failing {
+		return nil, notFound
+	}
+
+	dns.api.mu.Lock()
+	defer dns.api.mu.Unlock()
+	for _, m := range dns.api.machines {
+		m.settle(time.Now())
+		for _, name := range m.DomainNames {
+			if name == host && m.PrimaryIP != "" {
+				return []string{m.PrimaryIP}, nil
+			}
+		}
+	}
+	return nil, notFound
+}
+
+func (dns *fakeDNS) count() int {
+	dns.mu.Lock()
+	defer dns.mu.Unlock()
+	return dns.lookups
+}
+
+func TestCNSNameOnlyResolvedWhenNeeded(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	dns := &fakeDNS{api: api}
+	lookupHost = dns.lookupHost
+	defer func() { lookupHost = net.LookupHost }()
+
+	d := newTestDriver(t, api, testOptions{"use-cns": true})
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatalf("PreCreateCheck: %s", err)
+	}
+	if err := d.Create(); err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	name := d.IPAddress
+	if !strings.HasPrefix(name, "test-machine.inst.") {
+		t.Fatalf("IPAddress = %q, want the instance's CNS name", name)
+	}
+
+	lookups := dns.count()
+	for i := 0; i < 3; i++ {
+		checkState(t, d, state.Running)
+	}
+	if n := dns.count() - lookups; n != 0 {
+		t.Errorf("GetState made %d DNS lookups", n)
+	}
+
+	// a name that stops resolving for a moment is kept
+	dns.mu.Lock()
+	dns.failing = true
+	dns.mu.Unlock()
+	machine, err := d.getMachine(baseContext)
+	if err != nil {
+		t.Fatalf("getMachine: %s", err)
+	}
+	if err := d.updateAddress(baseContext, machine); err != nil {
+		t.Fatalf("updateAddress: %s", err)
+	}
+	if d.IPAddress != name {
+		t.Errorf("IPAddress = %q after a failed lookup, want %q", d.IPAddress, name)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// baseContext is the root of every CloudAPI call. It is cancelled when the
+// plugin is interrupted so calls in flight return instead of hanging.
+var baseContext, cancelBaseContext = context.WithCancel(context.Background())
+
+// how long the calls cancelled by a signal get to return their errors before
+// the signal takes effect
+var signalGracePeriod = 1 * time.Second
+
+// cancelOnSignal cancels baseContext when one of signals arrives. The signal
+// then gets its default behaviour back, and is delivered again after
+// signalGracePeriod so the plugin exits instead of waiting for libmachine to
+// notice it is gone.
+func cancelOnSignal(signals ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	go func() {
+		sig := <-ch
+		log.Infof("received %s, cancelling CloudAPI requests", sig)
+		cancelBaseContext()
+		signal.Stop(ch)
+
+		time.Sleep(signalGracePeriod)
+		if p, err := os.FindProcess(os.Getpid()); err == nil && p.Signal(sig) == nil {
+			return
+		}
+		// signals cannot be sent on Windows
+		os.Exit(1)
+	}()
+}
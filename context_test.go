@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSignalHelper is run by TestCancelOnSignal in a child process
+func TestSignalHelper(t *testing.T) {
+	if os.Getenv("GO_WANT_SIGNAL_HELPER") == "" {
+		t.Skip("only run by TestCancelOnSignal")
+	}
+
+	signalGracePeriod = 100 * time.Millisecond
+	cancelOnSignal(os.Interrupt)
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+
+	<-baseContext.Done()
+	fmt.Println("cancelled")
+	time.Sleep(10 * time.Second)
+	fmt.Println("still running")
+}
+
+func TestCancelOnSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals cannot be sent on Windows")
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSignalHelper$")
+	cmd.Env = append(os.Environ(), "GO_WANT_SIGNAL_HELPER=1")
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+
+	if !strings.Contains(string(out), "cancelled") {
+		t.Errorf("baseContext was not cancelled: %s", out)
+	}
+	if strings.Contains(string(out), "still running") || time.Since(start) > 5*time.Second {
+		t.Errorf("plugin kept running after the signal: %s", out)
+	}
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.Success() {
+		t.Errorf("plugin exited with %v, want it killed by the signal", err)
+	}
+}
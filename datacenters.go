@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/joyent/triton-go/compute"
+)
+
+// resolveDatacenter points the driver at the CloudAPI endpoint of
+// d.TritonDatacenter, as listed by the endpoint it is currently configured
+// with. The resolved URL is what gets saved, so later commands do not depend
+// on the lookup endpoint.
+func (d *Driver) resolveDatacenter(ctx context.Context, c *compute.ComputeClient) error {
+	datacenters, err := c.Datacenters().List(ctx, &compute.ListDataCentersInput{})
+	if err != nil {
+		return fmt.Errorf("error listing datacenters at %s: %s", d.TritonUrl, err)
+	}
+
+	names := make([]string, 0, len(datacenters))
+	for _, datacenter := range datacenters {
+		if datacenter.Name == d.TritonDatacenter {
+			if datacenter.URL != d.TritonUrl {
+				log.Infof("using datacenter %s at %s", datacenter.Name, datacenter.URL)
+				d.TritonUrl = datacenter.URL
+			}
+			return nil
+		}
+		names = append(names, datacenter.Name)
+	}
+
+	return fmt.Errorf("no datacenter %q is known to %s, choose one of: %s",
+		d.TritonDatacenter, d.TritonUrl, strings.Join(names, ", "))
+}
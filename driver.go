@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
-	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -13,18 +15,23 @@ import (
 	"github.com/docker/machine/libmachine/engine"
 	"github.com/docker/machine/libmachine/log"
 	"github.com/docker/machine/libmachine/mcnflag"
+	"github.com/docker/machine/libmachine/ssh"
 	"github.com/docker/machine/libmachine/state"
 
 	"github.com/joyent/triton-go"
+	"github.com/joyent/triton-go/account"
 	auth "github.com/joyent/triton-go/authentication"
+	"github.com/joyent/triton-go/client"
 	"github.com/joyent/triton-go/compute"
+	"github.com/joyent/triton-go/network"
 )
 
 const (
 	driverName = "triton"
 	flagPrefix = driverName + "-"
-	// SDC_ is for historical reasons
-	envPrefix = "SDC_"
+	envPrefix  = "TRITON_"
+	// SDC_ is still honoured for historical reasons
+	legacyEnvPrefix = "SDC_"
 )
 
 var (
@@ -37,6 +44,24 @@ var (
 	defaultTritonImage   = "debian-8"
 	defaultTritonPackage = "k4-highcpu-kvm-250M"
 	defaultSSHUser       = "root"
+
+	// seconds to wait for a new instance to come up
+	defaultTritonProvisionTimeout = 10 * 60
+
+	// seconds to wait for an instance to start, stop or reboot
+	defaultTritonStateTimeout = 5 * 60
+
+	// seconds to wait for a single CloudAPI request
+	defaultTritonAPITimeout = 60
+
+	// how long Kill lets a stop take before asking again
+	killGracePeriod = 30 * time.Second
+)
+
+// backoff bounds used while polling CloudAPI for state changes
+var (
+	pollInitialInterval = 1 * time.Second
+	pollMaxInterval     = 15 * time.Second
 )
 
 type Driver struct {
@@ -47,26 +72,155 @@ type Driver struct {
 	TritonKeyPath string
 	TritonKeyId   string
 	TritonUrl     string
+	// resolved to TritonUrl by PreCreateCheck
+	TritonDatacenter string
+
+	// TLS parameters
+	TritonCACert   string
+	TritonInsecure bool
+
+	// never persisted; later commands read it from the environment
+	TritonKeyPassphrase string `json:"-"`
 
 	// machine creation parameters
-	TritonImage   string
-	TritonPackage string
+	TritonImage            string
+	TritonPackage          string
+	TritonMemory           int
+	TritonVCPUs            int
+	TritonDisk             int
+	TritonPackageGroup     string
+	TritonBrand            string
+	TritonNetworks         []string
+	TritonMetadata         map[string]string
+	TritonTags             map[string]interface{}
+	TritonCNSServices      []string
+	TritonFirewall         bool
+	TritonFirewallSources  []string
+	TritonAffinity         []string
+	TritonLocalityNear     []string
+	TritonLocalityFar      []string
+	TritonLocalityStrict   bool
+	TritonProvisionTimeout int
+	TritonStateTimeout     int
+
+	// CloudAPI request parameters
+	TritonAPITimeout     int
+	TritonAPIMaxAttempts int
+	TritonAPIMaxBackoff  int
+
+	// image name resolution parameters
+	TritonImageOwner           string
+	TritonImageOS              string
+	TritonImageType            string
+	TritonImageIncludeInactive bool
+
+	// address selection parameters
+	TritonUseInternalIP bool
+	TritonIPNetwork     string
+	TritonUseCNS        bool
 
 	// machine state
-	TritonMachineId string
+	TritonMachineId     string
+	TritonFirewallRules []string
+
+	// status of the last CloudAPI response, for retries
+	responses *apiResponses
+	// CloudAPI clients, reused until the auth config changes
+	clients *apiClients
+	// whether a missing key passphrase may be prompted for, which is only
+	// done while creating the machine: other commands such as `ls` run one
+	// plugin per host at once
+	promptPassphrase bool
 }
 
 // SetConfigFromFlags configures the driver with the object that was returned by RegisterCreateFlags
 func (d *Driver) SetConfigFromFlags(opts drivers.DriverOptions) error {
-	d.TritonAccount = opts.String(flagPrefix + "account")
-	d.TritonKeyPath = opts.String(flagPrefix + "key-path")
-	d.TritonKeyId = opts.String(flagPrefix + "key-id")
-	d.TritonUrl = opts.String(flagPrefix + "url")
+	// only `docker-machine create` sets flags
+	d.promptPassphrase = true
+
+	profile, err := loadProfile(opts.String(flagPrefix + "profile"))
+	if err != nil {
+		return err
+	}
+	if profile == nil {
+		profile = &tritonProfile{}
+	}
+
+	// flags (and their TRITON_ variables) win over the profile, which wins
+	// over the legacy SDC_ variables; loadProfile leaves the CLI's current
+	// profile out when those are set
+	d.TritonAccount = configString(opts, "account", profile.Account, defaultTritonAccount)
+	d.TritonKeyPath = configString(opts, "key-path", "", defaultTritonKeyPath)
+	d.TritonKeyId = configString(opts, "key-id", profile.KeyID, defaultTritonKeyId)
+	d.TritonUrl = configString(opts, "url", profile.URL, defaultTritonUrl)
+	d.TritonDatacenter = opts.String(flagPrefix + "datacenter")
+	d.TritonKeyPassphrase = opts.String(flagPrefix + "key-passphrase")
+
+	d.TritonCACert = opts.String(flagPrefix + "ca-cert")
+	if d.TritonCACert != "" {
+		if d.TritonCACert, err = filepath.Abs(d.TritonCACert); err != nil {
+			return err
+		}
+		if _, err := loadCACerts(d.TritonCACert); err != nil {
+			return err
+		}
+	}
+	legacyInsecure, err := envInsecure()
+	if err != nil {
+		return err
+	}
+	d.TritonInsecure = opts.Bool(flagPrefix+"insecure") || profile.Insecure || legacyInsecure
+	if d.TritonInsecure {
+		log.Warnf("TLS certificate verification is DISABLED for %s: anyone between you and CloudAPI can impersonate it and sign requests as %s. Use --%sca-cert to trust a private CA instead.",
+			d.TritonUrl, d.TritonAccount, flagPrefix)
+	}
 
 	d.TritonImage = opts.String(flagPrefix + "image")
+	d.TritonImageOwner = opts.String(flagPrefix + "image-owner")
+	d.TritonImageOS = opts.String(flagPrefix + "image-os")
+	d.TritonImageType = opts.String(flagPrefix + "image-type")
+	d.TritonImageIncludeInactive = opts.Bool(flagPrefix + "image-include-inactive")
 	d.TritonPackage = opts.String(flagPrefix + "package")
-
-	d.SSHUser = opts.String(flagPrefix + "ssh-user")
+	d.TritonMemory = opts.Int(flagPrefix + "memory")
+	d.TritonVCPUs = opts.Int(flagPrefix + "vcpus")
+	d.TritonDisk = opts.Int(flagPrefix + "disk")
+	d.TritonPackageGroup = opts.String(flagPrefix + "package-group")
+	d.TritonBrand = opts.String(flagPrefix + "brand")
+	if d.TritonPackage == "" && d.packageRequirements().isZero() {
+		d.TritonPackage = defaultTritonPackage
+	}
+	d.TritonNetworks = opts.StringSlice(flagPrefix + "networks")
+	d.TritonMetadata, err = buildMetadata(
+		opts.StringSlice(flagPrefix+"metadata"),
+		opts.StringSlice(flagPrefix+"metadata-file"),
+		opts.String(flagPrefix+"user-data"),
+	)
+	if err != nil {
+		return err
+	}
+	d.TritonTags, err = parseTags(opts.StringSlice(flagPrefix + "tags"))
+	if err != nil {
+		return err
+	}
+	d.TritonCNSServices = opts.StringSlice(flagPrefix + "cns-services")
+	d.TritonFirewall = opts.Bool(flagPrefix + "firewall")
+	d.TritonFirewallSources = opts.StringSlice(flagPrefix + "firewall-source")
+	d.TritonAffinity = opts.StringSlice(flagPrefix + "affinity")
+	d.TritonLocalityNear = opts.StringSlice(flagPrefix + "locality-near")
+	d.TritonLocalityFar = opts.StringSlice(flagPrefix + "locality-far")
+	d.TritonLocalityStrict = opts.Bool(flagPrefix + "locality-strict")
+	d.TritonProvisionTimeout = opts.Int(flagPrefix + "provision-timeout")
+	d.TritonStateTimeout = opts.Int(flagPrefix + "state-timeout")
+	d.TritonAPITimeout = opts.Int(flagPrefix + "api-timeout")
+	d.TritonAPIMaxAttempts = opts.Int(flagPrefix + "api-max-attempts")
+	d.TritonAPIMaxBackoff = opts.Int(flagPrefix + "api-max-backoff")
+
+	d.TritonUseInternalIP = opts.Bool(flagPrefix + "use-internal-ip")
+	d.TritonIPNetwork = opts.String(flagPrefix + "ip-network")
+	d.TritonUseCNS = opts.Bool(flagPrefix + "use-cns")
+
+	d.SSHUser = configString(opts, "ssh-user", "", defaultSSHUser)
+	d.SSHKeyPath = opts.String(flagPrefix + "ssh-key-path")
 
 	d.SetSwarmConfigFromFlags(opts)
 
@@ -76,9 +230,6 @@ func (d *Driver) SetConfigFromFlags(opts drivers.DriverOptions) error {
 	// if d.TritonKeyPath == "" {
 	// 	return fmt.Errorf("%s driver requires the --%skey-path/%sKEY_PATH option", driverName, flagPrefix, envPrefix)
 	// }
-	if d.TritonKeyId == "" {
-		return fmt.Errorf("%s driver requires the --%skey-id/%sKEY_ID option", driverName, flagPrefix, envPrefix)
-	}
 	if d.TritonUrl == "" {
 		return fmt.Errorf("%s driver requires the --%surl/%sURL option", driverName, flagPrefix, envPrefix)
 	}
@@ -86,21 +237,101 @@ func (d *Driver) SetConfigFromFlags(opts drivers.DriverOptions) error {
 	if d.TritonImage == "" {
 		return fmt.Errorf("%s driver requires the --%simage option", driverName, flagPrefix)
 	}
-	if d.TritonPackage == "" {
-		return fmt.Errorf("%s driver requires the --%spackage option", driverName, flagPrefix)
+	if err := checkImageFilterFlags(d.TritonImageOwner, d.TritonImageType); err != nil {
+		return err
+	}
+	if err := checkBrand(d.TritonBrand); err != nil {
+		return err
+	}
+	if d.TritonMemory < 0 || d.TritonVCPUs < 0 || d.TritonDisk < 0 {
+		return fmt.Errorf("%s driver requires non-negative --%smemory, --%svcpus and --%sdisk", driverName, flagPrefix, flagPrefix, flagPrefix)
+	}
+	if d.TritonProvisionTimeout <= 0 {
+		return fmt.Errorf("%s driver requires a positive --%sprovision-timeout", driverName, flagPrefix)
+	}
+	if d.TritonStateTimeout <= 0 {
+		return fmt.Errorf("%s driver requires a positive --%sstate-timeout", driverName, flagPrefix)
+	}
+	if d.TritonAPITimeout <= 0 || d.TritonAPIMaxAttempts <= 0 || d.TritonAPIMaxBackoff <= 0 {
+		return fmt.Errorf("%s driver requires positive --%sapi-timeout, --%sapi-max-attempts and --%sapi-max-backoff",
+			driverName, flagPrefix, flagPrefix, flagPrefix)
+	}
+
+	if err := checkCNSServices(d.TritonCNSServices); err != nil {
+		return err
+	}
+
+	if d.TritonFirewall {
+		if len(d.TritonFirewallSources) == 0 {
+			return fmt.Errorf("%s driver requires at least one --%sfirewall-source with --%sfirewall", driverName, flagPrefix, flagPrefix)
+		}
+		if err := checkFirewallSources(d.TritonFirewallSources); err != nil {
+			return err
+		}
+	} else if len(d.TritonFirewallSources) > 0 {
+		return fmt.Errorf("%s driver only accepts --%sfirewall-source with --%sfirewall", driverName, flagPrefix, flagPrefix)
+	}
+
+	if d.SSHKeyPath != "" {
+		if _, err := os.Stat(d.SSHKeyPath); err != nil {
+			return fmt.Errorf("error locating SSH key from %s: %s", d.SSHKeyPath, err)
+		}
+	}
+
+	if d.TritonUseInternalIP && d.TritonIPNetwork != "" {
+		return fmt.Errorf("%s driver accepts only one of --%suse-internal-ip and --%sip-network", driverName, flagPrefix, flagPrefix)
 	}
 
 	return nil
 }
 
+// configString resolves a setting from its flag, then the profile, then the
+// legacy environment variable, then the default
+func configString(opts drivers.DriverOptions, name, profileValue, defaultValue string) string {
+	if value := opts.String(flagPrefix + name); value != "" {
+		return value
+	}
+	if profileValue != "" {
+		return profileValue
+	}
+	envName := strings.ToUpper(strings.Replace(name, "-", "_", -1))
+	if value := os.Getenv(legacyEnvPrefix + envName); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
 // GetCreateFlags returns the mcnflag.Flag slice representing the flags that can be set, their descriptions and defaults.
 func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 	return []mcnflag.Flag{
+		mcnflag.StringFlag{
+			EnvVar: envPrefix + "PROFILE",
+			Name:   flagPrefix + "profile",
+			Usage:  "Name of a triton CLI profile (~/.triton/profiles.d/<name>.json) to read the URL, account and key id from (defaults to the CLI's current profile)",
+			Value:  "",
+		},
 		mcnflag.StringFlag{
 			EnvVar: envPrefix + "URL",
 			Name:   flagPrefix + "url",
-			Usage:  "URL of the CloudAPI endpoint",
-			Value:  defaultTritonUrl,
+			Usage:  fmt.Sprintf("URL of the CloudAPI endpoint (default %q)", defaultTritonUrl),
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: envPrefix + "DATACENTER",
+			Name:   flagPrefix + "datacenter",
+			Usage:  fmt.Sprintf("Name of the datacenter to create the VM in, looked up through $%sURL", envPrefix),
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: envPrefix + "CA_CERT",
+			Name:   flagPrefix + "ca-cert",
+			Usage:  "PEM file, or directory of PEM files, with CA certificates to trust for the CloudAPI endpoint in addition to the system ones",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: envPrefix + "TLS_INSECURE",
+			Name:   flagPrefix + "insecure",
+			Usage:  "Do not verify the CloudAPI endpoint's TLS certificate (unsafe; for test installations only)",
 		},
 		mcnflag.StringFlag{
 			EnvVar: envPrefix + "ACCOUNT",
@@ -111,7 +342,7 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		mcnflag.StringFlag{
 			EnvVar: envPrefix + "KEY_ID",
 			Name:   flagPrefix + "key-id",
-			Usage:  fmt.Sprintf(`The fingerprint of $%sKEY_PATH (ssh-keygen -l -E md5 -f $%sKEY_PATH | awk '{ gsub(/^[^:]+:/, "", $2); print $2 }')`, envPrefix, envPrefix),
+			Usage:  fmt.Sprintf("The MD5 or SHA256 fingerprint of $%sKEY_PATH (derived from the key, or from the ssh-agent key registered with the account, when unset)", envPrefix),
 			Value:  defaultTritonKeyId,
 		},
 		mcnflag.StringFlag{
@@ -120,31 +351,190 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  fmt.Sprintf("A path to an SSH private key file that has been added to $%sACCOUNT", envPrefix),
 			Value:  defaultTritonKeyPath,
 		},
+		mcnflag.StringFlag{
+			EnvVar: envPrefix + "KEY_PASSPHRASE",
+			Name:   flagPrefix + "key-passphrase",
+			Usage:  fmt.Sprintf("Passphrase for an encrypted $%sKEY_PATH (prompted for during create if unset; not saved, so set $%sKEY_PASSPHRASE or use ssh-agent for later commands)", envPrefix, envPrefix),
+			Value:  "",
+		},
 
 		mcnflag.StringFlag{
 			Name:  flagPrefix + "image",
 			Usage: `VM image to provision ("debian-8", "debian-8@20150527", "ca291f66", etc)`,
 			Value: defaultTritonImage,
 		},
+		mcnflag.StringFlag{
+			Name:  flagPrefix + "image-owner",
+			Usage: `Only resolve image names to images owned by "self", "public" images or the account with this UUID`,
+			Value: "",
+		},
+		mcnflag.StringFlag{
+			Name:  flagPrefix + "image-os",
+			Usage: `Only resolve image names to images for this OS ("linux", etc)`,
+			Value: "",
+		},
+		mcnflag.StringFlag{
+			Name:  flagPrefix + "image-type",
+			Usage: `Only resolve image names to images of this type ("zvol", "lx-dataset", etc)`,
+			Value: "",
+		},
+		mcnflag.BoolFlag{
+			Name:  flagPrefix + "image-include-inactive",
+			Usage: "Also resolve image names to deprecated and disabled images",
+		},
 		mcnflag.StringFlag{
 			Name:  flagPrefix + "package",
-			Usage: `VM instance size to create ("g3-standard-0.25-kvm", "g3-standard-0.5-kvm", etc)`,
-			Value: defaultTritonPackage,
+			Usage: fmt.Sprintf(`VM instance size to create ("g3-standard-0.25-kvm", "g3-standard-0.5-kvm", etc; default %q unless package resources are given)`, defaultTritonPackage),
+			Value: "",
+		},
+		mcnflag.IntFlag{
+			Name:  flagPrefix + "memory",
+			Usage: "Pick the smallest package with at least this much memory, in MiB",
+			Value: 0,
+		},
+		mcnflag.IntFlag{
+			Name:  flagPrefix + "vcpus",
+			Usage: "Pick the smallest package with at least this many vCPUs",
+			Value: 0,
+		},
+		mcnflag.IntFlag{
+			Name:  flagPrefix + "disk",
+			Usage: "Pick the smallest package with at least this much disk, in MiB",
+			Value: 0,
+		},
+		mcnflag.StringFlag{
+			Name:  flagPrefix + "package-group",
+			Usage: `Pick the smallest package in this package group ("Standard", "High CPU", etc)`,
+			Value: "",
+		},
+		mcnflag.StringFlag{
+			Name:  flagPrefix + "brand",
+			Usage: `Pick the smallest package for this hypervisor ("kvm" or "bhyve")`,
+			Value: "",
+		},
+		mcnflag.StringSliceFlag{
+			Name:  flagPrefix + "networks",
+			Usage: `Network to attach the VM to, by name, UUID, short ID or "<fabric vlan>/<name>" (may be repeated; defaults to the account's default networks)`,
+			Value: []string{},
+		},
+		mcnflag.StringSliceFlag{
+			Name:  flagPrefix + "metadata",
+			Usage: `Metadata to set on the VM as KEY=VALUE, e.g. "user-script=..." (may be repeated)`,
+			Value: []string{},
+		},
+		mcnflag.StringSliceFlag{
+			Name:  flagPrefix + "metadata-file",
+			Usage: "Metadata to set on the VM as KEY=PATH, read from a file (may be repeated)",
+			Value: []string{},
+		},
+		mcnflag.StringFlag{
+			Name:  flagPrefix + "user-data",
+			Usage: fmt.Sprintf("Path to a cloud-init user-data file, passed as the %q metadata key", userDataMetadataKey),
+			Value: "",
+		},
+		mcnflag.StringSliceFlag{
+			Name:  flagPrefix + "tags",
+			Usage: `Tag to set on the VM as KEY=VALUE; "true", "false" and numbers are typed (may be repeated)`,
+			Value: []string{},
+		},
+		mcnflag.StringSliceFlag{
+			Name:  flagPrefix + "cns-services",
+			Usage: "Triton CNS service name to register the VM under (may be repeated)",
+			Value: []string{},
+		},
+		mcnflag.BoolFlag{
+			Name:  flagPrefix + "firewall",
+			Usage: "Enable the Triton Cloud Firewall on the VM, only allowing SSH and Docker from --triton-firewall-source",
+		},
+		mcnflag.StringSliceFlag{
+			Name:  flagPrefix + "firewall-source",
+			Usage: `Source allowed through the firewall: a CIDR, an IP address, "tag:NAME[=VALUE]", "auto" (this host's public IP) or "any" (may be repeated)`,
+			Value: []string{},
+		},
+		mcnflag.StringSliceFlag{
+			Name:  flagPrefix + "affinity",
+			Usage: `Affinity rule for placing the VM, e.g. "instance!=~swarm-mgr*" or "role==manager" (may be repeated)`,
+			Value: []string{},
+		},
+		mcnflag.StringSliceFlag{
+			Name:  flagPrefix + "locality-near",
+			Usage: "Instance (name, UUID or short ID) to place the VM on the same compute node as (may be repeated)",
+			Value: []string{},
+		},
+		mcnflag.StringSliceFlag{
+			Name:  flagPrefix + "locality-far",
+			Usage: "Instance (name, UUID or short ID) to keep the VM off the compute node of (may be repeated)",
+			Value: []string{},
+		},
+		mcnflag.BoolFlag{
+			Name:  flagPrefix + "locality-strict",
+			Usage: "Fail provisioning rather than ignore --triton-locality-near/--triton-locality-far",
+		},
+		mcnflag.IntFlag{
+			Name:  flagPrefix + "provision-timeout",
+			Usage: "Seconds to wait for a new instance to be running before giving up",
+			Value: defaultTritonProvisionTimeout,
+		},
+		mcnflag.IntFlag{
+			Name:  flagPrefix + "state-timeout",
+			Usage: "Seconds to wait for the VM to start, stop or restart before giving up",
+			Value: defaultTritonStateTimeout,
+		},
+		mcnflag.IntFlag{
+			Name:  flagPrefix + "api-timeout",
+			Usage: "Seconds to wait for a single CloudAPI request before abandoning it",
+			Value: defaultTritonAPITimeout,
+		},
+		mcnflag.IntFlag{
+			Name:  flagPrefix + "api-max-attempts",
+			Usage: "Times to try a CloudAPI call that was throttled or failed transiently (1 disables retries)",
+			Value: defaultTritonAPIMaxAttempts,
+		},
+		mcnflag.IntFlag{
+			Name:  flagPrefix + "api-max-backoff",
+			Usage: "Maximum seconds to wait between CloudAPI retries, unless CloudAPI asks for longer",
+			Value: defaultTritonAPIMaxBackoff,
+		},
+		mcnflag.BoolFlag{
+			Name:  flagPrefix + "use-internal-ip",
+			Usage: "Reach the VM on its first private address instead of its primary IP",
+		},
+		mcnflag.StringFlag{
+			Name:  flagPrefix + "ip-network",
+			Usage: `Reach the VM on its address in this network (name, UUID, short ID, "<fabric vlan>/<name>" or CIDR)`,
+			Value: "",
+		},
+		mcnflag.BoolFlag{
+			Name:  flagPrefix + "use-cns",
+			Usage: "Reach the VM on its Triton CNS instance name instead of its IP address",
 		},
 		mcnflag.StringFlag{
 			EnvVar: envPrefix + "SSH_USER",
 			Name:   flagPrefix + "ssh-user",
-			Usage:  "Triton SSH user",
-			Value:  defaultSSHUser,
+			Usage:  fmt.Sprintf("Triton SSH user (default %q)", defaultSSHUser),
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: envPrefix + "SSH_KEY_PATH",
+			Name:   flagPrefix + "ssh-key-path",
+			Usage:  "Path to an existing SSH private key that can already log in to the VM (by default a new key pair is generated for each machine)",
+			Value:  "",
 		},
 	}
 }
 
-func (d Driver) client() (*compute.ComputeClient, error) {
+func (d *Driver) clientConfig(transport http.RoundTripper) (*triton.ClientConfig, error) {
 	var signer auth.Signer
 	var err error
 
 	if d.TritonKeyPath == "" {
+		if d.TritonKeyId == "" {
+			d.TritonKeyId, err = agentKeyId(d.TritonUrl, d.TritonAccount, transport)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		signer, err = auth.NewSSHAgentSigner(d.TritonKeyId, d.TritonAccount)
 		if err != nil {
 			return nil, fmt.Errorf("error Creating SSH Agent Signer: %s", err)
@@ -155,46 +545,109 @@ func (d Driver) client() (*compute.ComputeClient, error) {
 				d.TritonKeyPath, err)
 		}
 
-		var keyBytes []byte
-		keyBytes, err = ioutil.ReadFile(d.TritonKeyPath)
-		if err != nil {
-			return nil, fmt.Errorf("error reading key material from %s: %s",
-				d.TritonKeyPath, err)
+		passphrase := d.TritonKeyPassphrase
+		if passphrase == "" {
+			passphrase = getEnv("KEY_PASSPHRASE")
 		}
 
-		block, _ := pem.Decode(keyBytes)
-		if block == nil {
-			return nil, fmt.Errorf("failed to read key material '%s': no key found",
-				d.TritonKeyPath)
+		key, usedPassphrase, err := loadPrivateKey(d.TritonKeyPath, []byte(passphrase), d.promptPassphrase)
+		if err != nil {
+			return nil, err
 		}
-		if block.Headers["Proc-Type"] == "4,ENCRYPTED" {
-			return nil, fmt.Errorf("failed to read key '%s': password protected keys are\n"+
-				"not currently supported. Please decrypt the key prior to use.",
-				d.TritonKeyPath)
+		// remember a prompted passphrase for the rest of this process
+		d.TritonKeyPassphrase = string(usedPassphrase)
+
+		d.TritonKeyId, err = keyIdFor(d.TritonKeyId, key.Public())
+		if err != nil {
+			return nil, err
 		}
 
-		signer, err = auth.NewPrivateKeySigner(d.TritonKeyId, []byte(d.TritonKeyPath), d.TritonAccount)
+		signer, err = newKeySigner(d.TritonKeyId, d.TritonAccount, key)
 		if err != nil {
 			return nil, fmt.Errorf("error creating SSH private key signer: %s", err)
 		}
 	}
 
-	config := &triton.ClientConfig{
+	return &triton.ClientConfig{
 		TritonURL:   d.TritonUrl,
 		AccountName: d.TritonAccount,
 		Signers:     []auth.Signer{signer},
+	}, nil
+}
+
+func (d *Driver) client() (*compute.ComputeClient, error) {
+	clients, err := d.apiClients()
+	if err != nil {
+		return nil, err
 	}
 
-	return compute.NewClient(config)
+	if clients.compute == nil {
+		c, err := compute.NewClient(clients.config)
+		if err != nil {
+			return nil, err
+		}
+		d.setupClient(c.Client)
+		clients.compute = c
+	}
+	return clients.compute, nil
 }
 
-func (d *Driver) getMachine() (*compute.Instance, error) {
+func (d *Driver) networkClient() (*network.NetworkClient, error) {
+	clients, err := d.apiClients()
+	if err != nil {
+		return nil, err
+	}
+
+	if clients.network == nil {
+		nc, err := network.NewClient(clients.config)
+		if err != nil {
+			return nil, err
+		}
+		d.setupClient(nc.Client)
+		clients.network = nc
+	}
+	return clients.network, nil
+}
+
+func (d *Driver) accountClient() (*account.AccountClient, error) {
+	clients, err := d.apiClients()
+	if err != nil {
+		return nil, err
+	}
+
+	if clients.account == nil {
+		ac, err := account.NewClient(clients.config)
+		if err != nil {
+			return nil, err
+		}
+		d.setupClient(ac.Client)
+		clients.account = ac
+	}
+	return clients.account, nil
+}
+
+// setupClient applies the per-request timeout, the shared transport and the
+// retry bookkeeping to a new CloudAPI client
+func (d *Driver) setupClient(c *client.Client) {
+	timeout := d.TritonAPITimeout
+	if timeout <= 0 {
+		// machines created before the option existed
+		timeout = defaultTritonAPITimeout
+	}
+	c.HTTPClient.Timeout = time.Duration(timeout) * time.Second
+	c.HTTPClient.Transport = d.recordResponses(d.clients.transport)
+}
+
+func (d *Driver) getMachine(ctx context.Context) (*compute.Instance, error) {
 	c, err := d.client()
 	if err != nil {
 		return nil, err
 	}
-	machine, err := c.Instances().Get(context.Background(), &compute.GetInstanceInput{
-		ID: d.TritonMachineId,
+
+	var machine *compute.Instance
+	err = d.retry(ctx, "get instance", true, func() error {
+		machine, err = getInstance(ctx, c, d.TritonMachineId)
+		return err
 	})
 	if err != nil {
 		return nil, err
@@ -202,12 +655,43 @@ func (d *Driver) getMachine() (*compute.Instance, error) {
 
 	log.Debugf("machine name: %s", machine.Name)
 
-	// update d.IPAddress since we know the value (saves later work)
-	d.IPAddress = machine.PrimaryIP
-
 	return machine, nil
 }
 
+// updateAddress points d.IPAddress at the address docker-machine should reach
+// machine on. Picking it may list the instance's NICs and resolve its CNS
+// names, so this is only done when the address is needed and never for
+// GetState. A CNS name once found is kept, so a lookup that fails for a
+// moment does not lose it.
+func (d *Driver) updateAddress(ctx context.Context, machine *compute.Instance) error {
+	c, err := d.client()
+	if err != nil {
+		return err
+	}
+
+	var ip string
+	err = d.retry(ctx, "get instance address", true, func() error {
+		ip, err = d.instanceIP(ctx, c, machine)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !d.TritonUseCNS {
+		d.IPAddress = ip
+		return nil
+	}
+
+	// the CNS name stands in for the IP everywhere docker-machine uses it
+	if ip != "" {
+		if name := cnsHostname(machine, ip); name != "" {
+			d.IPAddress = name
+		}
+	}
+	return nil
+}
+
 func NewDriver(hostName, storePath string) Driver {
 	return Driver{
 		TritonAccount: defaultTritonAccount,
@@ -215,6 +699,12 @@ func NewDriver(hostName, storePath string) Driver {
 		TritonKeyId:   defaultTritonKeyId,
 		TritonUrl:     defaultTritonUrl,
 
+		TritonProvisionTimeout: defaultTritonProvisionTimeout,
+		TritonStateTimeout:     defaultTritonStateTimeout,
+		TritonAPITimeout:       defaultTritonAPITimeout,
+		TritonAPIMaxAttempts:   defaultTritonAPIMaxAttempts,
+		TritonAPIMaxBackoff:    defaultTritonAPIMaxBackoff,
+
 		BaseDriver: &drivers.BaseDriver{
 			MachineName: hostName,
 			StorePath:   storePath,
@@ -228,26 +718,205 @@ func NewDriver(hostName, storePath string) Driver {
 
 // Create a host on Triton using the driver's CLI/environ config
 func (d *Driver) Create() error {
+	ctx, cancel := context.WithTimeout(baseContext, time.Duration(d.TritonProvisionTimeout)*time.Second)
+	defer cancel()
+
 	c, err := d.client()
 	if err != nil {
 		return err
 	}
 
+	metadata := map[string]string{}
+	for key, value := range d.TritonMetadata {
+		metadata[key] = value
+	}
+	if d.SSHKeyPath == "" {
+		publicKey, err := d.createSSHKey()
+		if err != nil {
+			return err
+		}
+		metadata["root_authorized_keys"] = d.authorizedKeys(ctx, metadata["root_authorized_keys"], publicKey)
+
+		if err := checkMetadataSize(metadata); err != nil {
+			return err
+		}
+	}
+
 	input := &compute.CreateInstanceInput{
-		Name:    d.MachineName,
-		Image:   d.TritonImage,
-		Package: d.TritonPackage,
+		Name:     d.MachineName,
+		Image:    d.TritonImage,
+		Package:  d.TritonPackage,
+		Networks: d.TritonNetworks,
+		Metadata: metadata,
+		Tags:     stringTags(d.instanceTags()),
+		CNS: compute.InstanceCNS{
+			Services: d.TritonCNSServices,
+		},
+		FirewallEnabled: d.TritonFirewall,
+		Affinity:        d.TritonAffinity,
+		LocalityNear:    d.TritonLocalityNear,
+		LocalityFar:     d.TritonLocalityFar,
+		LocalityStrict:  d.TritonLocalityStrict,
 	}
-	machine, err := c.Instances().Create(context.Background(), input)
+	machine, err := d.createInstance(ctx, c, input)
 	if err != nil {
 		return err
 	}
 
 	d.TritonMachineId = machine.ID
 
+	// the instance firewall blocks everything until these rules exist
+	if d.TritonFirewall {
+		nc, err := d.networkClient()
+		if err != nil {
+			return err
+		}
+		if err := d.createFirewallRules(ctx, nc); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("waiting for instance %q to be running", machine.ID)
+	if err := d.waitForRunning(ctx); err != nil {
+		return err
+	}
+
+	d.restoreTags(ctx, c)
 	return nil
 }
 
+// createSSHKey generates a key pair for this machine in the store path and
+// returns the public key to be authorized on the instance
+func (d *Driver) createSSHKey() (string, error) {
+	d.SSHKeyPath = d.ResolveStorePath("id_rsa")
+	log.Debugf("generating SSH key pair %s", d.SSHKeyPath)
+
+	if err := ssh.GenerateSSHKey(d.SSHKeyPath); err != nil {
+		return "", fmt.Errorf("error generating SSH key: %s", err)
+	}
+
+	publicKey, err := ioutil.ReadFile(d.SSHKeyPath + ".pub")
+	if err != nil {
+		return "", fmt.Errorf("error reading SSH public key: %s", err)
+	}
+
+	return string(publicKey), nil
+}
+
+// authorizedKeys builds root_authorized_keys from the keys the user authorized
+// themselves, the account's keys and the generated key. Setting it stops
+// Triton from installing the account's keys, so without them `triton ssh`
+// could not log in.
+func (d *Driver) authorizedKeys(ctx context.Context, userKeys, publicKey string) string {
+	var accountKeys []*account.Key
+	ac, err := d.accountClient()
+	if err == nil {
+		err = d.retry(ctx, "list account keys", true, func() error {
+			accountKeys, err = ac.Keys().List(ctx, &account.ListKeysInput{})
+			return err
+		})
+	}
+	if err != nil {
+		log.Warnf("could not list the SSH keys of account %q, so only the generated key will log in to the instance: %s", d.TritonAccount, err)
+	}
+
+	keys := strings.Split(userKeys, "\n")
+	for _, key := range accountKeys {
+		keys = append(keys, key.Key)
+	}
+	keys = append(keys, publicKey)
+
+	seen := map[string]bool{}
+	var authorized []string
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key != "" && !seen[key] {
+			seen[key] = true
+			authorized = append(authorized, key)
+		}
+	}
+	return strings.Join(authorized, "\n") + "\n"
+}
+
+// waitForRunning blocks until the new instance is running and has an address
+// docker-machine can reach, failing fast if provisioning fails.
+func (d *Driver) waitForRunning(ctx context.Context) error {
+	err := waitFor(ctx, func() (bool, error) {
+		machine, err := d.getMachine(ctx)
+		if err != nil {
+			return false, err
+		}
+		if machine.State == "failed" {
+			return false, fmt.Errorf("instance %s failed to provision", machine.ID)
+		}
+
+		s, err := instanceState(machine.State)
+		if err != nil {
+			return false, err
+		}
+		log.Debugf("instance %s is %s", machine.ID, machine.State)
+
+		if s == state.Running {
+			if err := d.updateAddress(ctx, machine); err != nil {
+				return false, err
+			}
+		}
+
+		if s == state.Running && d.IPAddress == "" && !d.TritonUseCNS && (d.TritonUseInternalIP || d.TritonIPNetwork != "") {
+			return false, fmt.Errorf("instance %s has no address matching the requested network", machine.ID)
+		}
+
+		if s == state.Running && d.IPAddress == "" && d.TritonUseCNS {
+			log.Debugf("waiting for a CNS name of instance %s to resolve", machine.ID)
+		}
+
+		done := s == state.Running && d.IPAddress != ""
+		if done {
+			log.Infof("%s instance %s is running on compute node %s", machine.Brand, machine.ID, machine.ComputeNode)
+		}
+		return done, nil
+	})
+	if err != nil {
+		return fmt.Errorf("error waiting for instance %s: %s", d.TritonMachineId, err)
+	}
+
+	return nil
+}
+
+// waitFor calls check with exponential backoff until it reports done, returns
+// an error, or ctx is done.
+func waitFor(ctx context.Context, check func() (bool, error)) error {
+	start := time.Now()
+	interval := pollInitialInterval
+
+	for {
+		done, err := check()
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timed out after %s", time.Since(start).Round(time.Second))
+		}
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("timed out after %s", time.Since(start).Round(time.Second))
+			}
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > pollMaxInterval {
+			interval = pollMaxInterval
+		}
+	}
+}
+
 // https://github.com/joyent/node-triton/blob/aeed6d91922ea117a42eac0cef4a3df67fbfed2f/lib/common.js#L306
 func uuidToShortId(s string) string {
 	return strings.SplitN(s, "-", 2)[0]
@@ -259,83 +928,114 @@ func iso8859(s string) (time.Time, error) {
 // PreCreateCheck allows for pre-create operations to make sure a driver is
 // ready for creation
 func (d *Driver) PreCreateCheck() error {
+	// every step only reads from CloudAPI, so the whole check can be repeated
+	ctx := baseContext
+	return d.retry(ctx, "pre-create check", true, func() error {
+		return d.preCreateCheck(ctx)
+	})
+}
+
+func (d *Driver) preCreateCheck(ctx context.Context) error {
 	c, err := d.client()
 	if err != nil {
 		return err
 	}
 
-	_, err = c.Ping(context.Background())
+	if d.TritonDatacenter != "" {
+		if err := d.resolveDatacenter(ctx, c); err != nil {
+			return err
+		}
+		// the clients follow the new URL
+		if c, err = d.client(); err != nil {
+			return err
+		}
+	}
+
+	_, err = ping(ctx, c)
 	if err != nil {
 		return err
 	}
 
-	_, err = c.Images().Get(context.Background(), &compute.GetImageInput{
-		ImageID: d.TritonImage,
-	})
+	filter, err := d.imageFilter(ctx)
 	if err != nil {
-		// apparently isn't a valid ID, but might be a name like "debian-8" (so
-		// let's do a lookup)
-		// https://github.com/joyent/node-triton/blob/aeed6d91922ea117a42eac0cef4a3df67fbfed2f/lib/tritonapi.js#L368
-		nameVersion := strings.SplitN(d.TritonImage, "@", 2)
-		name, version := nameVersion[0], ""
-		if len(nameVersion) == 2 {
-			version = nameVersion[1]
-		}
+		return err
+	}
+	image, err := resolveImage(ctx, c, d.TritonImage, filter)
+	if err != nil {
+		return err
+	}
+	d.TritonImage = image.ID
+	if err := checkImage(image); err != nil {
+		return err
+	}
 
-		listInput := &compute.ListImagesInput{}
-		listInput.State = "all"
-		if version != "" {
-			listInput.Name = name
-			listInput.Version = version
-		}
+	if err := d.resolvePackage(ctx, c, image); err != nil {
+		return err
+	}
 
-		images, imagesErr := c.Images().List(context.Background(), listInput)
-		if imagesErr != nil {
-			return imagesErr
+	if len(d.TritonNetworks) > 0 {
+		nc, err := d.networkClient()
+		if err != nil {
+			return err
 		}
-		nameMatches, shortIdMatches := []*compute.Image{}, []*compute.Image{}
-		for _, image := range images {
-			if name == image.Name {
-				nameMatches = append(nameMatches, image)
-			}
-			if name == uuidToShortId(image.ID) {
-				shortIdMatches = append(shortIdMatches, image)
-			}
+
+		networks, err := resolveNetworks(ctx, nc, d.TritonNetworks)
+		if err != nil {
+			return err
 		}
-		if len(nameMatches) == 1 {
-			log.Infof("resolved image %q to %q (exact name match)", d.TritonImage, nameMatches[0].ID)
-			d.TritonImage = nameMatches[0].ID
-		} else if len(nameMatches) > 1 {
-			mostRecent := nameMatches[0]
-			published := mostRecent.PublishedAt
-
-			for _, image := range nameMatches[1:] {
-				newPublished := image.PublishedAt
-				if published.Before(newPublished) {
-					mostRecent = image
-					published = newPublished
-				}
+		d.TritonNetworks = networks
+	}
+
+	if d.TritonIPNetwork != "" {
+		if _, _, err := net.ParseCIDR(d.TritonIPNetwork); err != nil {
+			nc, err := d.networkClient()
+			if err != nil {
+				return err
 			}
-			log.Infof("resolved image %q to %q (most recent of %d name matches)", d.TritonImage, mostRecent.ID, len(nameMatches))
-			d.TritonImage = mostRecent.ID
-		} else if len(shortIdMatches) == 1 {
-			log.Infof("resolved image %q to %q (exact short id match)", d.TritonImage, shortIdMatches[0].ID)
-			d.TritonImage = shortIdMatches[0].ID
-		} else {
-			if len(shortIdMatches) > 1 {
-				log.Warnf("image %q is an ambiguous short id", d.TritonImage)
+
+			networks, err := resolveNetworks(ctx, nc, []string{d.TritonIPNetwork})
+			if err != nil {
+				return err
 			}
-			return err
+			d.TritonIPNetwork = networks[0]
 		}
 	}
 
-	// GetPackage (and CreateMachine) both support package names and UUIDs interchangeably
-	pkgInput := &compute.GetPackageInput{
-		ID: d.TritonPackage,
+	if err := d.checkPlacement(); err != nil {
+		return err
 	}
-	if _, err := c.Packages().Get(context.Background(), pkgInput); err != nil {
+	if d.TritonLocalityNear, err = resolveInstances(ctx, c, d.TritonLocalityNear); err != nil {
 		return err
 	}
+	if d.TritonLocalityFar, err = resolveInstances(ctx, c, d.TritonLocalityFar); err != nil {
+		return err
+	}
+
+	if d.TritonFirewall {
+		sources, err := resolveFirewallSources(ctx, d.TritonFirewallSources)
+		if err != nil {
+			return err
+		}
+		d.TritonFirewallSources = sources
+	}
+
+	if d.TritonUseCNS || len(d.TritonCNSServices) > 0 {
+		ac, err := d.accountClient()
+		if err != nil {
+			return err
+		}
+
+		acct, err := ac.Get(ctx, &account.GetInput{})
+		if err != nil {
+			return err
+		}
+		if !acct.TritonCNSEnabled {
+			if d.TritonUseCNS {
+				return fmt.Errorf("--%suse-cns requires Triton CNS to be enabled for account %q (triton account update triton_cns_enabled=true)", flagPrefix, d.TritonAccount)
+			}
+			log.Warnf("Triton CNS is not enabled for account %q, so the CNS services will not be published", d.TritonAccount)
+		}
+	}
 
 	return nil
 }
@@ -351,11 +1051,17 @@ func (d *Driver) GetIP() (string, error) {
 	if d.IPAddress != "" {
 		return d.IPAddress, nil
 	}
-	machine, err := d.getMachine()
+	machine, err := d.getMachine(baseContext)
 	if err != nil {
 		return "", err
 	}
-	return machine.PrimaryIP, nil
+	if err := d.updateAddress(baseContext, machine); err != nil {
+		return "", err
+	}
+	if d.IPAddress == "" && d.TritonUseCNS {
+		return "", fmt.Errorf("no CNS name of instance %s resolves to its address", d.TritonMachineId)
+	}
+	return d.IPAddress, nil
 }
 
 // GetSSHHostname returns hostname for use with ssh
@@ -378,21 +1084,33 @@ func (d *Driver) GetURL() (string, error) {
 	return fmt.Sprintf("tcp://%s:%d", ip, engine.DefaultPort), nil
 }
 
+// GetSSHKeyPath returns the private key docker-machine uses to SSH into the
+// host, which is separate from the key used to sign CloudAPI requests
 func (d *Driver) GetSSHKeyPath() string {
-	return d.TritonKeyPath
+	if d.SSHKeyPath == "" {
+		// machines created before the driver generated its own keys were
+		// reached with the API signing key
+		return d.TritonKeyPath
+	}
+	return d.SSHKeyPath
 }
 
 // GetState returns the state that the host is in (running, stopped, etc)
 //
 // https://github.com/docker/machine/blob/v0.7.0/libmachine/state/state.go
 func (d *Driver) GetState() (state.State, error) {
-	machine, err := d.getMachine()
+	machine, err := d.getMachine(baseContext)
 	if err != nil {
 		return state.Error, err
 	}
 
+	return instanceState(machine.State)
+}
+
+// instanceState maps a Triton instance state onto a docker-machine state
+func instanceState(s string) (state.State, error) {
 	// https://github.com/joyent/smartos-live/blob/master/src/vm/man/vmadm.1m.md#vm-states
-	switch machine.State {
+	switch s {
 	case "configured", "provisioning":
 		return state.Starting, nil
 	case "failed", "receiving":
@@ -405,67 +1123,255 @@ func (d *Driver) GetState() (state.State, error) {
 		return state.Stopped, nil
 	}
 
-	return state.Error, fmt.Errorf("unknown Triton instance state: %s", machine.State)
+	return state.Error, fmt.Errorf("unknown Triton instance state: %s", s)
 }
 
-// Kill stops a host forcefully
+// Kill stops a host forcefully. CloudAPI has no forced stop, so if the
+// instance ignores the first stop for killGracePeriod it is asked again.
 func (d *Driver) Kill() error {
-	return d.Stop()
+	ctx, cancel := d.stateContext()
+	defer cancel()
+
+	c, err := d.client()
+	if err != nil {
+		return err
+	}
+
+	if err := d.stopInstance(ctx, c); err != nil {
+		return err
+	}
+	graceCtx, cancelGrace := context.WithTimeout(ctx, killGracePeriod)
+	defer cancelGrace()
+	if err := d.waitForInstance(graceCtx, "stop", isStopped); err == nil {
+		return nil
+	} else if ctx.Err() != nil {
+		return err
+	}
+
+	log.Warnf("instance %s did not stop within %s, stopping it again", d.TritonMachineId, killGracePeriod)
+	if err := d.stopInstance(ctx, c); err != nil {
+		return err
+	}
+	return d.waitForInstance(ctx, "stop", isStopped)
 }
 
-// Remove a host
+// Remove a host and everything the driver created for it. Anything already
+// gone is skipped, so a partially created or partially removed machine can
+// always be removed.
 func (d *Driver) Remove() error {
-	c, err := d.client()
+	ctx, cancel := d.stateContext()
+	defer cancel()
+
+	if d.TritonMachineId != "" {
+		c, err := d.client()
+		if err != nil {
+			return err
+		}
+		if err := d.deleteInstance(ctx, c); err != nil {
+			return err
+		}
+	}
+
+	if len(d.TritonFirewallRules) > 0 {
+		nc, err := d.networkClient()
+		if err != nil {
+			return err
+		}
+		if err := d.deleteFirewallRules(ctx, nc); err != nil {
+			return err
+		}
+	}
+
+	return d.removeSSHKey()
+}
+
+// deleteInstance deletes the instance and waits until CloudAPI reports it
+// gone
+func (d *Driver) deleteInstance(ctx context.Context, c *compute.ComputeClient) error {
+	err := d.retry(ctx, "delete instance", true, func() error {
+		return destroyInstance(ctx, c, d.TritonMachineId)
+	})
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
-	input := &compute.DeleteInstanceInput{
-		ID: d.TritonMachineId,
+	err = waitFor(ctx, func() (bool, error) {
+		var machine *compute.Instance
+		err := d.retry(ctx, "get instance", true, func() error {
+			var err error
+			machine, err = getInstance(ctx, c, d.TritonMachineId)
+			if compute.IsResourceNotFound(err) {
+				return nil
+			}
+			return err
+		})
+		if machine == nil && err == nil {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		log.Debugf("instance %s is %s", machine.ID, machine.State)
+		return machine.State == "deleted", nil
+	})
+	if err != nil {
+		return fmt.Errorf("error waiting for instance %s to be deleted: %s", d.TritonMachineId, err)
+	}
+	return nil
+}
+
+// removeSSHKey deletes the key pair createSSHKey generated, leaving keys the
+// user supplied alone
+func (d *Driver) removeSSHKey() error {
+	keyPath := d.ResolveStorePath("id_rsa")
+	if d.SSHKeyPath != keyPath {
+		return nil
+	}
+
+	for _, path := range []string{keyPath, keyPath + ".pub"} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing SSH key: %s", err)
+		}
 	}
-	return c.Instances().Delete(ctx, input)
+	return nil
 }
 
 // Restart a host. This may just call Stop(); Start() if the provider does not
 // have any special restart behaviour.
 func (d *Driver) Restart() error {
+	ctx, cancel := d.stateContext()
+	defer cancel()
+
 	c, err := d.client()
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
+	var before *compute.Instance
+	err = d.retry(ctx, "get instance", true, func() error {
+		before, err = getInstance(ctx, c, d.TritonMachineId)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
 	input := &compute.RebootInstanceInput{
 		InstanceID: d.TritonMachineId,
 	}
-	return c.Instances().Reboot(ctx, input)
+	err = d.retry(ctx, "reboot instance", false, func() error {
+		return c.Instances().Reboot(ctx, input)
+	})
+	if err != nil {
+		return err
+	}
+
+	// a quick reboot may never be seen leaving "running", but it still
+	// bumps the instance's update time
+	rebooted := false
+	err = d.waitForInstance(ctx, "restart", func(machine *compute.Instance, s state.State) bool {
+		if s != state.Running {
+			rebooted = true
+			return false
+		}
+		return rebooted || machine.Updated.After(before.Updated)
+	})
+	if err != nil {
+		return err
+	}
+
+	d.restoreTags(ctx, c)
+	return nil
 }
 
 // Start a host
 func (d *Driver) Start() error {
+	ctx, cancel := d.stateContext()
+	defer cancel()
+
 	c, err := d.client()
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
 	input := &compute.StartInstanceInput{
 		InstanceID: d.TritonMachineId,
 	}
-	return c.Instances().Start(ctx, input)
+	err = d.retry(ctx, "start instance", true, func() error {
+		return c.Instances().Start(ctx, input)
+	})
+	if err != nil {
+		return err
+	}
+	if err := d.waitForInstance(ctx, "start", isRunning); err != nil {
+		return err
+	}
+
+	d.restoreTags(ctx, c)
+	return nil
 }
 
 // Stop a host gracefully
 func (d *Driver) Stop() error {
+	ctx, cancel := d.stateContext()
+	defer cancel()
+
 	c, err := d.client()
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
+	if err := d.stopInstance(ctx, c); err != nil {
+		return err
+	}
+	return d.waitForInstance(ctx, "stop", isStopped)
+}
+
+func (d *Driver) stopInstance(ctx context.Context, c *compute.ComputeClient) error {
 	input := &compute.StopInstanceInput{
 		InstanceID: d.TritonMachineId,
 	}
-	return c.Instances().Stop(ctx, input)
+	return d.retry(ctx, "stop instance", true, func() error {
+		return c.Instances().Stop(ctx, input)
+	})
+}
+
+// stateContext bounds an operation that waits for the instance to change
+// state by the state timeout
+func (d *Driver) stateContext() (context.Context, context.CancelFunc) {
+	timeout := d.TritonStateTimeout
+	if timeout <= 0 {
+		// machines created before the option existed
+		timeout = defaultTritonStateTimeout
+	}
+	return context.WithTimeout(baseContext, time.Duration(timeout)*time.Second)
+}
+
+func isRunning(_ *compute.Instance, s state.State) bool { return s == state.Running }
+func isStopped(_ *compute.Instance, s state.State) bool { return s == state.Stopped }
+
+// waitForInstance polls the instance until done accepts it; action names the
+// operation in errors
+func (d *Driver) waitForInstance(ctx context.Context, action string, done func(*compute.Instance, state.State) bool) error {
+	err := waitFor(ctx, func() (bool, error) {
+		machine, err := d.getMachine(ctx)
+		if err != nil {
+			return false, err
+		}
+		if machine.State == "failed" {
+			return false, fmt.Errorf("instance %s failed", machine.ID)
+		}
+
+		s, err := instanceState(machine.State)
+		if err != nil {
+			return false, err
+		}
+		log.Debugf("instance %s is %s", machine.ID, machine.State)
+
+		return done(machine, s), nil
+	})
+	if err != nil {
+		return fmt.Errorf("error waiting for instance %s to %s: %s", d.TritonMachineId, action, err)
+	}
+	return nil
 }
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnflag"
+	"github.com/docker/machine/libmachine/state"
+	"github.com/joyent/triton-go/compute"
+)
+
+func TestMain(m *testing.M) {
+	// keep the developer's triton CLI config, agent and environment out
+	home, err := ioutil.TempDir("", "triton-driver-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", home)
+	os.Unsetenv("SSH_AUTH_SOCK")
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+		if strings.HasPrefix(name, envPrefix) || strings.HasPrefix(name, legacyEnvPrefix) {
+			os.Unsetenv(name)
+		}
+	}
+
+	pollInitialInterval = 5 * time.Millisecond
+	pollMaxInterval = 20 * time.Millisecond
+	retryInitialBackoff = 5 * time.Millisecond
+
+	log.SetOutWriter(ioutil.Discard)
+	log.SetErrWriter(ioutil.Discard)
+
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// testOptions are the command line flags given to the driver, on top of the
+// defaults of its create flags
+type testOptions map[string]interface{}
+
+func (o testOptions) String(key string) string {
+	s, _ := o[key].(string)
+	return s
+}
+
+func (o testOptions) StringSlice(key string) []string {
+	s, _ := o[key].([]string)
+	return s
+}
+
+func (o testOptions) Int(key string) int {
+	i, _ := o[key].(int)
+	return i
+}
+
+func (o testOptions) Bool(key string) bool {
+	b, _ := o[key].(bool)
+	return b
+}
+
+func createFlagDefaults(d *Driver) testOptions {
+	opts := testOptions{}
+	for _, flag := range d.GetCreateFlags() {
+		switch f := flag.(type) {
+		case mcnflag.StringFlag:
+			opts[f.Name] = f.Value
+		case mcnflag.StringSliceFlag:
+			opts[f.Name] = f.Value
+		case mcnflag.IntFlag:
+			opts[f.Name] = f.Value
+		}
+	}
+	return opts
+}
+
+// writeTestKey writes a new ECDSA key to dir, returning its path and the
+// fingerprint api knows it by
+func writeTestKey(t testing.TB, api *fakeCloudAPI, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "triton_key")
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, api.addKey(t, key.Public())
+}
+
+// newTestDriver configures a driver for api from flags, signing with a key
+// registered with the account
+func newTestDriver(t testing.TB, api *fakeCloudAPI, flags testOptions) *Driver {
+	storePath := t.TempDir()
+	keyPath, _ := writeTestKey(t, api, storePath)
+
+	driver := NewDriver("test-machine", storePath)
+	d := &driver
+	opts := createFlagDefaults(d)
+	opts[flagPrefix+"url"] = api.URL
+	opts[flagPrefix+"account"] = api.account
+	opts[flagPrefix+"key-path"] = keyPath
+	opts[flagPrefix+"image"] = "ubuntu-certified-16.04"
+	opts[flagPrefix+"package"] = "k4-highcpu-kvm-1.75G"
+	for name, value := range flags {
+		opts[flagPrefix+name] = value
+	}
+	if err := d.SetConfigFromFlags(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(d.ResolveStorePath("."), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func checkState(t *testing.T, d *Driver, want state.State) {
+	t.Helper()
+	s, err := d.GetState()
+	if err != nil {
+		t.Fatalf("GetState: %s", err)
+	}
+	if s != want {
+		t.Fatalf("GetState = %s, want %s", s, want)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	d := newTestDriver(t, api, nil)
+
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatalf("PreCreateCheck: %s", err)
+	}
+	if d.TritonImage != fakeImageID {
+		t.Errorf("TritonImage = %q, want the resolved ID %q", d.TritonImage, fakeImageID)
+	}
+
+	if err := d.Create(); err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	machine := api.machine(d.TritonMachineId)
+	if machine == nil {
+		t.Fatalf("instance %q was not created", d.TritonMachineId)
+	}
+	if machine.Name != "test-machine" || machine.Package != "k4-highcpu-kvm-1.75G" {
+		t.Errorf("created %s with package %s", machine.Name, machine.Package)
+	}
+	if machine.Tags[machineNameTag] != "test-machine" || machine.Tags[machineDriverTag] != driverName {
+		t.Errorf("instance tags = %v", machine.Tags)
+	}
+	publicKey, err := ioutil.ReadFile(d.GetSSHKeyPath() + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(machine.Metadata["root_authorized_keys"], strings.TrimSpace(string(publicKey))) {
+		t.Errorf("root_authorized_keys does not authorize the generated key")
+	}
+	if d.IPAddress != machine.PrimaryIP {
+		t.Errorf("IPAddress = %q, want %q", d.IPAddress, machine.PrimaryIP)
+	}
+	checkState(t, d, state.Running)
+
+	if err := d.Stop(); err != nil {
+		t.Fatalf("Stop: %s", err)
+	}
+	checkState(t, d, state.Stopped)
+
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	checkState(t, d, state.Running)
+
+	if err := d.Restart(); err != nil {
+		t.Fatalf("Restart: %s", err)
+	}
+	checkState(t, d, state.Running)
+
+	if err := d.Remove(); err != nil {
+		t.Fatalf("Remove: %s", err)
+	}
+	if _, err := d.GetState(); err == nil {
+		t.Errorf("GetState succeeded after Remove")
+	}
+	if _, err := os.Stat(d.GetSSHKeyPath()); !os.IsNotExist(err) {
+		t.Errorf("generated SSH key was not removed: %v", err)
+	}
+}
+
+func TestLifecycleFirewall(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	d := newTestDriver(t, api, testOptions{
+		"firewall":        true,
+		"firewall-source": []string{"203.0.113.7", "tag:bastion"},
+	})
+
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatalf("PreCreateCheck: %s", err)
+	}
+	if err := d.Create(); err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	if !api.machine(d.TritonMachineId).FirewallEnabled {
+		t.Errorf("instance was created without its firewall enabled")
+	}
+	if len(d.TritonFirewallRules) != 1 {
+		t.Fatalf("TritonFirewallRules = %v, want one rule", d.TritonFirewallRules)
+	}
+	api.mu.Lock()
+	rule := api.fwrules[d.TritonFirewallRules[0]]
+	api.mu.Unlock()
+	want := `FROM (ip 203.0.113.7 OR tag "bastion") TO vm ` + d.TritonMachineId + " ALLOW tcp (PORT 22 AND PORT 2376)"
+	if rule == nil || rule.Rule != want || !rule.Enabled {
+		t.Fatalf("firewall rule = %+v, want enabled %q", rule, want)
+	}
+
+	if err := d.Remove(); err != nil {
+		t.Fatalf("Remove: %s", err)
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if len(api.fwrules) != 0 || len(d.TritonFirewallRules) != 0 {
+		t.Errorf("firewall rules left after Remove: %v", api.fwrules)
+	}
+}
+
+func TestPreCreateCheckRejectsZoneImage(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	d := newTestDriver(t, api, testOptions{"image": "base-64-lts"})
+
+	err := d.PreCreateCheck()
+	if err == nil || !strings.Contains(err.Error(), "zone-dataset") {
+		t.Fatalf("PreCreateCheck = %v, want a zone image error", err)
+	}
+}
+
+func TestUnregisteredKeyIsRejected(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	d := newTestDriver(t, api, nil)
+
+	// a key of the same type the account does not know
+	other := newFakeCloudAPI(t)
+	d.TritonKeyPath, _ = writeTestKey(t, other, t.TempDir())
+	d.TritonKeyId = ""
+
+	err := d.PreCreateCheck()
+	if err == nil || !strings.Contains(err.Error(), "InvalidCredentials") {
+		t.Fatalf("PreCreateCheck = %v, want InvalidCredentials", err)
+	}
+}
+
+// hangMachineRequests makes api sit on instance lookups until the client
+// gives up, reporting each one on arrived
+func hangMachineRequests(api *fakeCloudAPI, arrived chan<- struct{}) {
+	api.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodGet || !strings.Contains(r.URL.Path, "/machines/") {
+			return false
+		}
+		arrived <- struct{}{}
+		<-r.Context().Done()
+		return true
+	})
+}
+
+func countRequests(api *fakeCloudAPI, request string) int {
+	n := 0
+	for _, r := range api.requestLog() {
+		if r == request {
+			n++
+		}
+	}
+	return n
+}
+
+func TestGetStateTimeout(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	d := newTestDriver(t, api, testOptions{"api-max-attempts": 2})
+	d.TritonMachineId = api.addMachine("test-machine", nil).ID
+
+	c, err := d.client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Client.HTTPClient.Timeout = 50 * time.Millisecond
+	arrived := make(chan struct{}, 10)
+	hangMachineRequests(api, arrived)
+
+	s, err := d.GetState()
+	if err == nil {
+		t.Fatalf("GetState = %s, want a timeout error", s)
+	}
+	if s != state.Error {
+		t.Errorf("GetState = %s, want %s", s, state.Error)
+	}
+	// a timeout is transient, so the lookup was repeated
+	if n := countRequests(api, "GET /test/machines/"+d.TritonMachineId); n != 2 {
+		t.Errorf("instance was looked up %d times, want 2", n)
+	}
+}
+
+func TestGetMachineCancelled(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	d := newTestDriver(t, api, nil)
+	d.TritonMachineId = api.addMachine("test-machine", nil).ID
+
+	arrived := make(chan struct{}, 10)
+	hangMachineRequests(api, arrived)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-arrived
+		cancel()
+	}()
+
+	if _, err := d.getMachine(ctx); err == nil {
+		t.Fatal("getMachine succeeded after being cancelled")
+	}
+	// a cancelled request is not repeated
+	if n := countRequests(api, "GET /test/machines/"+d.TritonMachineId); n != 1 {
+		t.Errorf("instance was looked up %d times, want 1", n)
+	}
+}
+
+func TestGetStateServerError(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	d := newTestDriver(t, api, nil)
+	d.TritonMachineId = api.addMachine("test-machine", nil).ID
+
+	var mu sync.Mutex
+	failures := 2
+	api.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures == 0 || !strings.Contains(r.URL.Path, "/machines/") {
+			return false
+		}
+		failures--
+		writeError(w, http.StatusInternalServerError, "InternalError", "try again")
+		return true
+	})
+
+	// a server error is reported as such, not decoded as an instance, and
+	// retried
+	checkState(t, d, state.Running)
+	if n := countRequests(api, "GET /test/machines/"+d.TritonMachineId); n != 3 {
+		t.Errorf("instance was looked up %d times, want 3", n)
+	}
+}
+
+func TestWaitForRunning(t *testing.T) {
+	tests := []struct {
+		name            string
+		transition      time.Duration
+		provisionResult string
+		ipDelay         time.Duration
+		timeout         time.Duration
+		err             string
+	}{
+		{name: "running", transition: 30 * time.Millisecond, provisionResult: "running"},
+		{name: "waits for IP", transition: 10 * time.Millisecond, provisionResult: "running", ipDelay: 60 * time.Millisecond},
+		{name: "failed", transition: 10 * time.Millisecond, provisionResult: "failed", err: "failed to provision"},
+		{name: "timeout", transition: time.Hour, provisionResult: "running", timeout: 100 * time.Millisecond, err: "timed out"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeCloudAPI(t)
+			api.transition = test.transition
+			api.provisionResult = test.provisionResult
+			api.ipDelay = test.ipDelay
+			d := newTestDriver(t, api, nil)
+
+			timeout := test.timeout
+			if timeout == 0 {
+				timeout = 10 * time.Second
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			c, err := d.client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			machine, err := d.createInstance(ctx, c, &compute.CreateInstanceInput{
+				Name:    d.MachineName,
+				Image:   fakeImageID,
+				Package: "k4-highcpu-kvm-1.75G",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.TritonMachineId = machine.ID
+
+			start := time.Now()
+			err = d.waitForRunning(ctx)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("waitForRunning = %v, want an error containing %q", err, test.err)
+				}
+				// failures are reported as soon as they are seen
+				if elapsed := time.Since(start); test.provisionResult == "failed" && elapsed > time.Second {
+					t.Errorf("failure took %s to report", elapsed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("waitForRunning: %s", err)
+			}
+
+			m := api.machine(machine.ID)
+			if m.State != "running" {
+				t.Errorf("instance is %s", m.State)
+			}
+			if d.IPAddress == "" || d.IPAddress != m.PrimaryIP {
+				t.Errorf("IPAddress = %q, want %q", d.IPAddress, m.PrimaryIP)
+			}
+		})
+	}
+}
+
+func TestCreateAuthorizesAccountKeys(t *testing.T) {
+	const userKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIEXAMPLEKEYEXAMPLEKEYEXAMPLEKEYEXAMPLEKEY user@example.com"
+
+	for _, listFails := range []bool{false, true} {
+		api := newFakeCloudAPI(t)
+		d := newTestDriver(t, api, testOptions{"metadata": []string{"root_authorized_keys=" + userKey}})
+		if listFails {
+			api.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+				if r.URL.Path != "/test/keys" {
+					return false
+				}
+				writeError(w, http.StatusForbidden, "NotAuthorized", "no access to keys")
+				return true
+			})
+		}
+		if err := d.PreCreateCheck(); err != nil {
+			t.Fatalf("PreCreateCheck: %s", err)
+		}
+		if err := d.Create(); err != nil {
+			t.Fatalf("Create: %s", err)
+		}
+
+		publicKey, err := ioutil.ReadFile(d.GetSSHKeyPath() + ".pub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var accountKey string
+		api.mu.Lock()
+		for _, key := range api.keys {
+			sshKey, err := ssh.NewPublicKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			accountKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshKey)))
+		}
+		api.mu.Unlock()
+
+		want := []string{userKey, accountKey, strings.TrimSpace(string(publicKey))}
+		if listFails {
+			want = []string{userKey, strings.TrimSpace(string(publicKey))}
+		}
+		got := api.machine(d.TritonMachineId).Metadata["root_authorized_keys"]
+		if got != strings.Join(want, "\n")+"\n" {
+			t.Errorf("listing fails %t: root_authorized_keys = %q, want %q", listFails, got, want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/engine"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/joyent/triton-go/compute"
+	"github.com/joyent/triton-go/network"
+)
+
+const (
+	// service answering with the caller's public IP, used for the "auto"
+	// firewall source
+	egressIPURL = "https://api.ipify.org"
+
+	swarmMasterPort = 3376
+)
+
+// "tag:NAME" or "tag:NAME=VALUE"
+var firewallTagPattern = regexp.MustCompile(`^tag:([^=]+)(?:=(.*))?$`)
+
+// checkFirewallSources validates --triton-firewall-source values without
+// resolving "auto", which needs the network
+func checkFirewallSources(sources []string) error {
+	for _, source := range sources {
+		if source == "auto" {
+			continue
+		}
+		if _, err := firewallSource(source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// firewallSource turns a source into Triton firewall rule syntax: a CIDR, an
+// IP address, "tag:NAME[=VALUE]" or "any"
+func firewallSource(source string) (string, error) {
+	if source == "any" {
+		return "any", nil
+	}
+	if _, _, err := net.ParseCIDR(source); err == nil {
+		return "subnet " + source, nil
+	}
+	if ip := net.ParseIP(source); ip != nil {
+		return "ip " + ip.String(), nil
+	}
+	if m := firewallTagPattern.FindStringSubmatch(source); m != nil {
+		if m[2] == "" {
+			return fmt.Sprintf("tag %q", m[1]), nil
+		}
+		return fmt.Sprintf("tag %q = %q", m[1], m[2]), nil
+	}
+	return "", fmt.Errorf(`invalid firewall source %q, expected a CIDR, an IP address, "tag:NAME[=VALUE]", "auto" or "any"`, source)
+}
+
+// resolveFirewallSources replaces "auto" with the IP address this host
+// reaches the internet from
+func resolveFirewallSources(ctx context.Context, sources []string) ([]string, error) {
+	resolved := make([]string, 0, len(sources))
+	for _, source := range sources {
+		if source == "auto" {
+			ip, err := egressIP(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error detecting this host's public IP for the firewall: %s", err)
+			}
+			log.Infof("allowing this host's public IP %s through the firewall", ip)
+			source = ip
+		}
+		resolved = append(resolved, source)
+	}
+	return resolved, nil
+}
+
+func egressIP(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, egressIPURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", egressIPURL, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return "", fmt.Errorf("%s returned %q, not an IP address", egressIPURL, body)
+	}
+	return ip.String(), nil
+}
+
+// firewallRule allows SSH, the Docker daemon and, on swarm masters, the
+// swarm manager port into the instance from the configured sources
+func (d *Driver) firewallRule() (string, error) {
+	sources := make([]string, 0, len(d.TritonFirewallSources))
+	for _, source := range d.TritonFirewallSources {
+		s, err := firewallSource(source)
+		if err != nil {
+			return "", err
+		}
+		if s == "any" {
+			// "any" can't be combined with other sources and covers them all
+			sources = []string{s}
+			break
+		}
+		sources = append(sources, s)
+	}
+
+	from := strings.Join(sources, " OR ")
+	if len(sources) > 1 {
+		from = "(" + from + ")"
+	}
+
+	ports := []string{"PORT 22", fmt.Sprintf("PORT %d", engine.DefaultPort)}
+	if d.SwarmMaster {
+		ports = append(ports, fmt.Sprintf("PORT %d", swarmMasterPort))
+	}
+
+	return fmt.Sprintf("FROM %s TO vm %s ALLOW tcp (%s)", from, d.TritonMachineId, strings.Join(ports, " AND ")), nil
+}
+
+// createFirewallRules adds the machine's rules, recording their IDs so Remove
+// deletes exactly what was created here
+func (d *Driver) createFirewallRules(ctx context.Context, nc *network.NetworkClient) error {
+	rule, err := d.firewallRule()
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("creating firewall rule %q", rule)
+	var created *network.FirewallRule
+	err = d.retry(ctx, "create firewall rule", false, func() error {
+		created, err = nc.Firewall().CreateRule(ctx, &network.CreateRuleInput{
+			Enabled:     true,
+			Rule:        rule,
+			Description: fmt.Sprintf("docker-machine %s (%s)", d.MachineName, d.TritonMachineId),
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error creating firewall rule for instance %s: %s", d.TritonMachineId, err)
+	}
+
+	d.TritonFirewallRules = append(d.TritonFirewallRules, created.ID)
+	return nil
+}
+
+// deleteFirewallRules removes the rules this driver created. Rules that are
+// already gone are not an error.
+func (d *Driver) deleteFirewallRules(ctx context.Context, nc *network.NetworkClient) error {
+	for len(d.TritonFirewallRules) > 0 {
+		id := d.TritonFirewallRules[0]
+		log.Debugf("deleting firewall rule %s", id)
+
+		err := d.retry(ctx, "delete firewall rule", true, func() error {
+			return nc.Firewall().DeleteRule(ctx, &network.DeleteRuleInput{
+				ID: id,
+			})
+		})
+		if err != nil && !compute.IsResourceNotFound(err) {
+			return fmt.Errorf("error deleting firewall rule %s: %s", id, err)
+		}
+		d.TritonFirewallRules = d.TritonFirewallRules[1:]
+	}
+	return nil
+}
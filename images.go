@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/joyent/triton-go/account"
+	"github.com/joyent/triton-go/compute"
+)
+
+var (
+	uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+	// image types CloudAPI knows about
+	imageTypes = []string{"zvol", "zone-dataset", "lx-dataset", "docker", "other"}
+)
+
+// imageFilter narrows down the images an image name may resolve to
+type imageFilter struct {
+	Owner           string // account UUID, or "public" for any public image
+	OS              string
+	Type            string
+	IncludeInactive bool
+}
+
+func (f imageFilter) matches(image *compute.Image) bool {
+	switch {
+	case f.Owner == "public" && !image.Public:
+		return false
+	case f.Owner != "" && f.Owner != "public" && image.Owner != f.Owner:
+		return false
+	case f.OS != "" && image.OS != f.OS:
+		return false
+	case f.Type != "" && image.Type != f.Type:
+		return false
+	case !f.IncludeInactive && image.State != "active":
+		return false
+	}
+	return true
+}
+
+func (f imageFilter) String() string {
+	var parts []string
+	if !f.IncludeInactive {
+		parts = append(parts, "active")
+	}
+	switch f.Owner {
+	case "":
+	case "public":
+		parts = append(parts, "public")
+	default:
+		parts = append(parts, fmt.Sprintf("owned by %s", f.Owner))
+	}
+	if f.OS != "" {
+		parts = append(parts, fmt.Sprintf("os %q", f.OS))
+	}
+	if f.Type != "" {
+		parts = append(parts, fmt.Sprintf("type %q", f.Type))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func checkImageFilterFlags(owner, imageType string) error {
+	if owner != "" && owner != "self" && owner != "public" && !uuidPattern.MatchString(owner) {
+		return fmt.Errorf(`invalid --%simage-owner %q, expected "self", "public" or an account UUID`, flagPrefix, owner)
+	}
+	if imageType != "" {
+		for _, t := range imageTypes {
+			if imageType == t {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid --%simage-type %q, expected one of %s", flagPrefix, imageType, strings.Join(imageTypes, ", "))
+	}
+	return nil
+}
+
+// imageFilter builds the filter from the driver's flags, looking up the
+// account UUID for --triton-image-owner=self
+func (d *Driver) imageFilter(ctx context.Context) (imageFilter, error) {
+	filter := imageFilter{
+		Owner:           d.TritonImageOwner,
+		OS:              d.TritonImageOS,
+		Type:            d.TritonImageType,
+		IncludeInactive: d.TritonImageIncludeInactive,
+	}
+	if filter.Owner == "self" {
+		ac, err := d.accountClient()
+		if err != nil {
+			return filter, err
+		}
+		acct, err := ac.Get(ctx, &account.GetInput{})
+		if err != nil {
+			return filter, err
+		}
+		filter.Owner = acct.ID
+	}
+	return filter, nil
+}
+
+// resolveImage maps an image UUID, "name", "name@version" or short ID onto an
+// image. Names only resolve to images passing the filter, picking the highest
+// version; UUIDs and short IDs are taken as given.
+func resolveImage(ctx context.Context, c *compute.ComputeClient, ref string, filter imageFilter) (*compute.Image, error) {
+	image, err := c.Images().Get(ctx, &compute.GetImageInput{
+		ImageID: ref,
+	})
+	if err == nil {
+		return image, nil
+	}
+
+	// apparently isn't a valid ID, but might be a name like "debian-8" (so
+	// let's do a lookup)
+	// https://github.com/joyent/node-triton/blob/aeed6d91922ea117a42eac0cef4a3df67fbfed2f/lib/tritonapi.js#L368
+	nameVersion := strings.SplitN(ref, "@", 2)
+	name, version := nameVersion[0], ""
+	if len(nameVersion) == 2 {
+		version = nameVersion[1]
+	}
+
+	listInput := &compute.ListImagesInput{}
+	listInput.State = "all"
+	if version != "" {
+		listInput.Name = name
+		listInput.Version = version
+	}
+
+	images, imagesErr := c.Images().List(ctx, listInput)
+	if imagesErr != nil {
+		return nil, imagesErr
+	}
+	nameMatches, shortIdMatches := []*compute.Image{}, []*compute.Image{}
+	filtered := 0
+	for _, image := range images {
+		if name == image.Name {
+			if filter.matches(image) {
+				nameMatches = append(nameMatches, image)
+			} else {
+				filtered++
+			}
+		}
+		if name == uuidToShortId(image.ID) {
+			shortIdMatches = append(shortIdMatches, image)
+		}
+	}
+	if len(nameMatches) == 1 {
+		log.Infof("resolved image %q to %q (exact name match)", ref, nameMatches[0].ID)
+		return nameMatches[0], nil
+	} else if len(nameMatches) > 1 {
+		sortImages(nameMatches)
+		mostRecent := nameMatches[0]
+		log.Infof("resolved image %q to %q (version %s, most recent of %d name matches)", ref, mostRecent.ID, mostRecent.Version, len(nameMatches))
+		return mostRecent, nil
+	} else if len(shortIdMatches) == 1 {
+		log.Infof("resolved image %q to %q (exact short id match)", ref, shortIdMatches[0].ID)
+		return shortIdMatches[0], nil
+	}
+
+	if filtered > 0 {
+		return nil, fmt.Errorf("none of the %d images named %q is %s (see the --%simage-* options)", filtered, ref, filter, flagPrefix)
+	}
+	if len(shortIdMatches) > 1 {
+		log.Warnf("image %q is an ambiguous short id", ref)
+	}
+	return nil, err
+}
+
+// sortImages orders images newest first: by version, then by publish date
+// for equal versions
+func sortImages(images []*compute.Image) {
+	sort.SliceStable(images, func(i, j int) bool {
+		a, b := images[i], images[j]
+		if c := compareVersions(a.Version, b.Version); c != 0 {
+			return c > 0
+		}
+		return a.PublishedAt.After(b.PublishedAt)
+	})
+}
+
+var versionSeparators = regexp.MustCompile(`[.\-+_]`)
+
+// compareVersions orders image versions such as "20170424", "16.04.2" or
+// "17.1.0-rc1" component by component, numerically where both components are
+// numbers. It returns -1, 0 or 1.
+func compareVersions(a, b string) int {
+	as, bs := versionSeparators.Split(a, -1), versionSeparators.Split(b, -1)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.ParseUint(as[i], 10, 64)
+		bn, bErr := strconv.ParseUint(bs[i], 10, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				return compareInts(an, bn)
+			}
+		case aErr == nil:
+			// numbers sort after words, so "1.0.0" > "1.0.rc1"
+			return 1
+		case bErr == nil:
+			return -1
+		default:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	// a trailing word marks a pre-release, so "1.0.0-rc1" < "1.0.0" < "1.0.0.1"
+	switch {
+	case len(as) < len(bs):
+		return -isNumericVersion(bs[len(as)])
+	case len(as) > len(bs):
+		return isNumericVersion(as[len(bs)])
+	}
+	return 0
+}
+
+// isNumericVersion returns 1 for a numeric version component, -1 otherwise
+func isNumericVersion(s string) int {
+	if _, err := strconv.ParseUint(s, 10, 64); err != nil {
+		return -1
+	}
+	return 1
+}
+
+func compareInts(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
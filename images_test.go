@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joyent/triton-go/compute"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"16.04.2", "16.04.2", 0},
+		{"16.04.2", "16.04.10", -1},
+		{"16.04.10", "16.04.2", 1},
+		{"20170424", "20180222", -1},
+		{"1.0.0-rc1", "1.0.0", -1},
+		{"1.0.0", "1.0.0-rc1", 1},
+		{"1.0.0-rc1", "1.0.0-rc2", -1},
+		{"1.0.0", "1.0.0.1", -1},
+		{"1.0.rc1", "1.0.0", -1},
+		{"17.1.0_1", "17.1.0+2", -1},
+		{"beta", "alpha", 1},
+	}
+
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestSortImages(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2018, 1, d, 0, 0, 0, 0, time.UTC) }
+	images := []*compute.Image{
+		{ID: "a", Version: "16.04.2", PublishedAt: day(1)},
+		{ID: "b", Version: "16.04.10", PublishedAt: day(2)},
+		{ID: "c", Version: "16.04.10-rc1", PublishedAt: day(3)},
+		{ID: "d", Version: "16.04.10", PublishedAt: day(4)},
+	}
+
+	sortImages(images)
+
+	var order []string
+	for _, image := range images {
+		order = append(order, image.ID)
+	}
+	if got := strings.Join(order, ","); got != "d,b,c,a" {
+		t.Errorf("sorted images = %s, want d,b,c,a", got)
+	}
+}
+
+func TestImageFilterMatches(t *testing.T) {
+	const owner = "4c1f0fa1-5e5b-4c7f-9d8e-0b83e11f1ee0"
+	public := &compute.Image{OS: "linux", Type: "zvol", State: "active", Public: true}
+	private := &compute.Image{OS: "linux", Type: "zvol", State: "active", Owner: owner}
+	deprecated := &compute.Image{OS: "linux", Type: "zvol", State: "deprecated", Public: true}
+
+	tests := []struct {
+		name   string
+		filter imageFilter
+		image  *compute.Image
+		want   bool
+	}{
+		{"no filter", imageFilter{}, public, true},
+		{"inactive", imageFilter{}, deprecated, false},
+		{"include inactive", imageFilter{IncludeInactive: true}, deprecated, true},
+		{"public", imageFilter{Owner: "public"}, public, true},
+		{"public rejects private", imageFilter{Owner: "public"}, private, false},
+		{"owner", imageFilter{Owner: owner}, private, true},
+		{"other owner", imageFilter{Owner: owner}, public, false},
+		{"os", imageFilter{OS: "linux"}, public, true},
+		{"other os", imageFilter{OS: "smartos"}, public, false},
+		{"type", imageFilter{Type: "zvol"}, public, true},
+		{"other type", imageFilter{Type: "lx-dataset"}, public, false},
+	}
+
+	for _, test := range tests {
+		if got := test.filter.matches(test.image); got != test.want {
+			t.Errorf("%s: %s matches = %t, want %t", test.name, test.filter, got, test.want)
+		}
+	}
+}
+
+func TestResolveImage(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	api.images = append(api.images,
+		&compute.Image{ID: "0a6e7c6c-1e3a-11e8-8f5b-0f0d5c0c2c01", Name: "ubuntu-16.04", Version: "16.04.2", OS: "linux", Type: "zvol", State: "active", Public: true},
+		&compute.Image{ID: "1b7f8d7d-1e3a-11e8-8f5b-0f0d5c0c2c02", Name: "ubuntu-16.04", Version: "16.04.10", OS: "linux", Type: "zvol", State: "active", Public: true},
+		&compute.Image{ID: "2c809e8e-1e3a-11e8-8f5b-0f0d5c0c2c03", Name: "ubuntu-16.04", Version: "16.04.11", OS: "linux", Type: "zvol", State: "disabled", Public: true},
+		&compute.Image{ID: "3d91af9f-1e3a-11e8-8f5b-0f0d5c0c2c04", Name: "ubuntu-16.04", Version: "16.04.12", OS: "linux", Type: "zvol", State: "active", Owner: api.accountID},
+	)
+	d := newTestDriver(t, api, nil)
+	c, err := d.client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		ref    string
+		filter imageFilter
+		want   string
+		err    string
+	}{
+		{name: "uuid", ref: fakeImageID, want: fakeImageID},
+		{name: "short id", ref: "8b9ba1e4", want: fakeImageID},
+		{name: "name", ref: "ubuntu-certified-16.04", want: fakeImageID},
+		{name: "highest version", ref: "ubuntu-16.04", want: "3d91af9f-1e3a-11e8-8f5b-0f0d5c0c2c04"},
+		{name: "name@version", ref: "ubuntu-16.04@16.04.2", want: "0a6e7c6c-1e3a-11e8-8f5b-0f0d5c0c2c01"},
+		{name: "public only", ref: "ubuntu-16.04", filter: imageFilter{Owner: "public"}, want: "1b7f8d7d-1e3a-11e8-8f5b-0f0d5c0c2c02"},
+		{name: "own only", ref: "ubuntu-16.04", filter: imageFilter{Owner: api.accountID}, want: "3d91af9f-1e3a-11e8-8f5b-0f0d5c0c2c04"},
+		{name: "include inactive", ref: "ubuntu-16.04", filter: imageFilter{Owner: "public", IncludeInactive: true}, want: "2c809e8e-1e3a-11e8-8f5b-0f0d5c0c2c03"},
+		{name: "inactive version", ref: "ubuntu-16.04@16.04.11", err: `none of the 1 images named "ubuntu-16.04@16.04.11" is active`},
+		{name: "all filtered", ref: "ubuntu-16.04", filter: imageFilter{OS: "smartos"}, err: `none of the 4 images named "ubuntu-16.04"`},
+		{name: "unknown", ref: "centos-7", err: "ResourceNotFound"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			image, err := resolveImage(context.Background(), c, test.ref, test.filter)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("resolveImage(%q) = %v, want an error containing %q", test.ref, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveImage(%q): %s", test.ref, err)
+			}
+			if image.ID != test.want {
+				t.Errorf("resolveImage(%q) = %s@%s (%s), want %s", test.ref, image.Name, image.Version, image.ID, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/joyent/triton-go/client"
+	"github.com/joyent/triton-go/compute"
+)
+
+// The vendored triton-go reads the response of Instances().Get, Ping and
+// Instances().Delete before checking whether there was one, so a timeout,
+// an interrupt or a dropped connection either panics or turns into an error
+// the retry logic cannot recognise. These make the same requests but look at
+// the transport error first.
+
+// executeRaw makes a request and returns the response for the caller to
+// inspect and close; CloudAPI errors are left to the caller
+func executeRaw(ctx context.Context, c *compute.ComputeClient, method, path string) (*http.Response, error) {
+	return c.Client.ExecuteRequestRaw(ctx, client.RequestInput{
+		Method: method,
+		Path:   path,
+	})
+}
+
+// isGone reports whether CloudAPI has no such resource. Deleted instances
+// are answered with 410 Gone.
+func isGone(response *http.Response) bool {
+	return response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone
+}
+
+func notFound(response *http.Response) error {
+	return &client.TritonError{
+		StatusCode: response.StatusCode,
+		Code:       "ResourceNotFound",
+	}
+}
+
+// getInstance looks up an instance like Instances().Get. Its tags include the
+// triton.cns.* ones, which are not split out into Instance.CNS.
+func getInstance(ctx context.Context, c *compute.ComputeClient, id string) (*compute.Instance, error) {
+	response, err := executeRaw(ctx, c, http.MethodGet, fmt.Sprintf("/%s/machines/%s", c.Client.AccountName, id))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if isGone(response) {
+		return nil, notFound(response)
+	}
+	if response.StatusCode >= http.StatusBadRequest {
+		return nil, c.Client.DecodeError(response.StatusCode, response.Body)
+	}
+
+	machine := &compute.Instance{}
+	if err := json.NewDecoder(response.Body).Decode(machine); err != nil {
+		return nil, fmt.Errorf("error decoding instance %s: %s", id, err)
+	}
+	return machine, nil
+}
+
+// destroyInstance deletes an instance like Instances().Delete; an instance
+// that is already gone is not an error
+func destroyInstance(ctx context.Context, c *compute.ComputeClient, id string) error {
+	response, err := executeRaw(ctx, c, http.MethodDelete, fmt.Sprintf("/%s/machines/%s", c.Client.AccountName, id))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if isGone(response) {
+		return nil
+	}
+	if response.StatusCode >= http.StatusBadRequest {
+		return c.Client.DecodeError(response.StatusCode, response.Body)
+	}
+	return nil
+}
+
+// ping checks the endpoint is a CloudAPI like ComputeClient.Ping
+func ping(ctx context.Context, c *compute.ComputeClient) (*compute.PingOutput, error) {
+	response, err := executeRaw(ctx, c, http.MethodGet, "/--ping")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if isGone(response) {
+		return nil, notFound(response)
+	}
+	if response.StatusCode >= http.StatusBadRequest {
+		return nil, c.Client.DecodeError(response.StatusCode, response.Body)
+	}
+
+	result := &compute.PingOutput{}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("error decoding CloudAPI ping: %s", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/docker/machine/libmachine/log"
+
+	"github.com/joyent/triton-go"
+	"github.com/joyent/triton-go/account"
+	auth "github.com/joyent/triton-go/authentication"
+)
+
+// loadPrivateKey reads a PEM or OpenSSH format private key, decrypting it with
+// passphrase or, if prompt is set, a passphrase read from the terminal
+func loadPrivateKey(path string, passphrase []byte, prompt bool) (crypto.Signer, []byte, error) {
+	keyBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading key material from %s: %s", path, err)
+	}
+
+	rawKey, err := ssh.ParseRawPrivateKey(keyBytes)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		if len(passphrase) == 0 && !prompt {
+			return nil, nil, passphraseMissing(path)
+		}
+		if len(passphrase) == 0 {
+			passphrase, err = readPassphrase(path)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		rawKey, err = ssh.ParseRawPrivateKeyWithPassphrase(keyBytes, passphrase)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read key '%s': %s", path, err)
+	}
+
+	// ed25519 keys in OpenSSH format are returned by pointer
+	if key, ok := rawKey.(*ed25519.PrivateKey); ok {
+		rawKey = *key
+	}
+
+	key, ok := rawKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("failed to read key '%s': unsupported key type %T", path, rawKey)
+	}
+
+	return key, passphrase, nil
+}
+
+// readPassphrase prompts for the passphrase of an encrypted key. The plugin's
+// stdin is not connected to the user, so this goes through the controlling
+// terminal directly.
+func readPassphrase(path string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, passphraseMissing(path)
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "Enter passphrase for %s: ", path)
+	passphrase, err := terminal.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return nil, fmt.Errorf("error reading passphrase for '%s': %s", path, err)
+	}
+
+	return passphrase, nil
+}
+
+func passphraseMissing(path string) error {
+	return fmt.Errorf("key '%s' is password protected: provide --%skey-passphrase/%sKEY_PASSPHRASE or add it to ssh-agent",
+		path, flagPrefix, envPrefix)
+}
+
+// newKeySigner builds a CloudAPI request signer for a decrypted private key
+func newKeySigner(keyId, accountName string, key crypto.Signer) (auth.Signer, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		// the triton-go signer only accepts unencrypted PKCS#1 PEM
+		keyBytes := pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(k),
+		})
+		return auth.NewPrivateKeySigner(keyId, keyBytes, accountName)
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return newCryptoSigner(keyId, accountName, k, crypto.SHA256, "ecdsa-sha256")
+		case elliptic.P384():
+			return newCryptoSigner(keyId, accountName, k, crypto.SHA384, "ecdsa-sha384")
+		case elliptic.P521():
+			return newCryptoSigner(keyId, accountName, k, crypto.SHA512, "ecdsa-sha512")
+		}
+		return nil, fmt.Errorf("unsupported ECDSA curve %s", k.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		// ed25519 hashes internally, so the message is signed as-is
+		return newCryptoSigner(keyId, accountName, k, crypto.Hash(0), "ed25519-sha512")
+	}
+
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+// cryptoSigner signs requests with the ECDSA and Ed25519 keys the triton-go
+// PrivateKeySigner does not support
+type cryptoSigner struct {
+	key         crypto.Signer
+	hash        crypto.Hash
+	algorithm   string
+	fingerprint string
+	keyId       string
+}
+
+func newCryptoSigner(keyId, accountName string, key crypto.Signer, hash crypto.Hash, algorithm string) (*cryptoSigner, error) {
+	publicKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return nil, fmt.Errorf("error reading public key: %s", err)
+	}
+
+	fingerprint := ssh.FingerprintLegacyMD5(publicKey)
+	if keyId != fingerprint {
+		return nil, fmt.Errorf("private key does not match key id %s", keyId)
+	}
+
+	return &cryptoSigner{
+		key:         key,
+		hash:        hash,
+		algorithm:   algorithm,
+		fingerprint: fingerprint,
+		keyId:       fmt.Sprintf("/%s/keys/%s", accountName, fingerprint),
+	}, nil
+}
+
+func (s *cryptoSigner) DefaultAlgorithm() string {
+	return s.algorithm
+}
+
+func (s *cryptoSigner) KeyFingerprint() string {
+	return s.fingerprint
+}
+
+func (s *cryptoSigner) Sign(dateHeader string) (string, error) {
+	const headerName = "date"
+
+	signature, algorithm, err := s.SignRaw(fmt.Sprintf("%s: %s", headerName, dateHeader))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`Signature keyId="%s",algorithm="%s",headers="%s",signature="%s"`,
+		s.keyId, algorithm, headerName, signature), nil
+}
+
+func (s *cryptoSigner) SignRaw(toSign string) (string, string, error) {
+	message := []byte(toSign)
+	if s.hash != 0 {
+		h := s.hash.New()
+		h.Write(message)
+		message = h.Sum(nil)
+	}
+
+	// ECDSA signatures come back ASN.1 encoded, as HTTP signatures expect
+	signed, err := s.key.Sign(rand.Reader, message, s.hash)
+	if err != nil {
+		return "", "", fmt.Errorf("error signing request: %s", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(signed), s.algorithm, nil
+}
+
+// keyIdFor returns the MD5 fingerprint CloudAPI identifies publicKey by. keyId
+// may be empty, in which case it is derived, or an MD5 or SHA256 fingerprint
+// that must match the key.
+func keyIdFor(keyId string, publicKey crypto.PublicKey) (string, error) {
+	sshKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("error reading public key: %s", err)
+	}
+	md5Fingerprint := ssh.FingerprintLegacyMD5(sshKey)
+
+	switch {
+	case keyId == "":
+		log.Debugf("using key id %s derived from the private key", md5Fingerprint)
+	case strings.HasPrefix(keyId, "SHA256:"):
+		if keyId != ssh.FingerprintSHA256(sshKey) {
+			return "", fmt.Errorf("private key does not match key id %s", keyId)
+		}
+	case strings.TrimPrefix(keyId, "MD5:") != md5Fingerprint:
+		return "", fmt.Errorf("private key does not match key id %s", keyId)
+	}
+
+	return md5Fingerprint, nil
+}
+
+// agentKeyId picks the single key in ssh-agent that is registered with the
+// account, for when no key id was given
+func agentKeyId(tritonUrl, accountName string, transport http.RoundTripper) (string, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return "", fmt.Errorf("%s driver requires --%skey-id, --%skey-path or a running ssh-agent", driverName, flagPrefix, flagPrefix)
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return "", fmt.Errorf("error dialing SSH agent: %s", err)
+	}
+	defer conn.Close()
+
+	agentKeys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return "", fmt.Errorf("error listing keys in SSH agent: %s", err)
+	}
+	if len(agentKeys) == 0 {
+		return "", fmt.Errorf("ssh-agent has no keys; add one or set --%skey-id", flagPrefix)
+	}
+
+	// listing the account's keys needs a signed request, so try each agent
+	// key until one is accepted
+	var accountKeys []*account.Key
+	for _, key := range agentKeys {
+		accountKeys, err = listAccountKeys(tritonUrl, accountName, ssh.FingerprintLegacyMD5(key), transport)
+		if err == nil {
+			break
+		}
+		log.Debugf("agent key %s (%s) was not accepted: %s", ssh.FingerprintLegacyMD5(key), key.Comment, err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("none of the %d keys in ssh-agent is registered with account %q: %s", len(agentKeys), accountName, err)
+	}
+
+	registered := map[string]bool{}
+	for _, key := range accountKeys {
+		registered[key.Fingerprint] = true
+	}
+
+	candidates := []*agent.Key{}
+	for _, key := range agentKeys {
+		if registered[ssh.FingerprintLegacyMD5(key)] {
+			candidates = append(candidates, key)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no key in ssh-agent is registered with account %q, set --%skey-id", accountName, flagPrefix)
+	}
+	if len(candidates) > 1 {
+		descriptions := make([]string, 0, len(candidates))
+		for _, key := range candidates {
+			descriptions = append(descriptions, fmt.Sprintf("%s (%s)", ssh.FingerprintLegacyMD5(key), key.Comment))
+		}
+		return "", fmt.Errorf("several keys in ssh-agent are registered with account %q, choose one with --%skey-id: %s",
+			accountName, flagPrefix, strings.Join(descriptions, ", "))
+	}
+
+	keyId := ssh.FingerprintLegacyMD5(candidates[0])
+	log.Infof("using ssh-agent key %s (%s)", keyId, candidates[0].Comment)
+
+	return keyId, nil
+}
+
+func listAccountKeys(tritonUrl, accountName, keyId string, transport http.RoundTripper) ([]*account.Key, error) {
+	signer, err := auth.NewSSHAgentSigner(keyId, accountName)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := account.NewClient(&triton.ClientConfig{
+		TritonURL:   tritonUrl,
+		AccountName: accountName,
+		Signers:     []auth.Signer{signer},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.Client.HTTPClient.Timeout = time.Duration(defaultTritonAPITimeout) * time.Second
+	a.Client.HTTPClient.Transport = transport
+
+	return a.Keys().List(baseContext, &account.ListKeysInput{})
+}
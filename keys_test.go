@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/docker/machine/libmachine/state"
+)
+
+func TestEncryptedKeyIsOnlyPromptedForOnCreate(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "triton_key")
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	api.addKey(t, key.Public())
+
+	// a driver loaded from the machine's config, as for `docker-machine ls`
+	driver := NewDriver("test-machine", t.TempDir())
+	d := &driver
+	d.TritonUrl = api.URL
+	d.TritonAccount = api.account
+	d.TritonKeyPath = keyPath
+	d.TritonMachineId = api.addMachine("test-machine", nil).ID
+
+	_, err = d.GetState()
+	if err == nil || !strings.Contains(err.Error(), "is password protected") {
+		t.Fatalf("GetState = %v, want an error asking for the passphrase", err)
+	}
+
+	t.Setenv(envPrefix+"KEY_PASSPHRASE", "secret")
+	checkState(t, d, state.Running)
+}
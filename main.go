@@ -1,9 +1,13 @@
 package main
 
 import (
+	"os"
+	"syscall"
+
 	"github.com/docker/machine/libmachine/drivers/plugin"
 )
 
 func main() {
+	cancelOnSignal(os.Interrupt, syscall.SIGTERM)
 	plugin.RegisterDriver(new(Driver))
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// key cloud-init reads user-data from on Triton images
+	userDataMetadataKey = "cloud-init:user-data"
+
+	// Triton's default limit on the total size of an instance's metadata
+	maxMetadataSize = 32 * 1024
+)
+
+// parseKeyValue splits a KEY=VALUE flag argument
+func parseKeyValue(flag, s string) (string, string, error) {
+	keyValue := strings.SplitN(s, "=", 2)
+	if len(keyValue) != 2 || keyValue[0] == "" {
+		return "", "", fmt.Errorf("invalid --%s%s %q, expected KEY=VALUE", flagPrefix, flag, s)
+	}
+	return keyValue[0], keyValue[1], nil
+}
+
+// buildMetadata gathers the user's metadata from KEY=VALUE pairs, KEY=PATH
+// files and a cloud-init user-data file into a single map
+func buildMetadata(pairs, files []string, userDataPath string) (map[string]string, error) {
+	metadata := map[string]string{}
+
+	for _, pair := range pairs {
+		key, value, err := parseKeyValue("metadata", pair)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = value
+	}
+
+	for _, pair := range files {
+		key, path, err := parseKeyValue("metadata-file", pair)
+		if err != nil {
+			return nil, err
+		}
+		value, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading metadata %q from %s: %s", key, path, err)
+		}
+		metadata[key] = string(value)
+	}
+
+	if userDataPath != "" {
+		if _, ok := metadata[userDataMetadataKey]; ok {
+			return nil, fmt.Errorf("--%suser-data conflicts with metadata key %q", flagPrefix, userDataMetadataKey)
+		}
+		value, err := ioutil.ReadFile(userDataPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading user-data from %s: %s", userDataPath, err)
+		}
+		metadata[userDataMetadataKey] = string(value)
+	}
+
+	if err := checkMetadataSize(metadata); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+func checkMetadataSize(metadata map[string]string) error {
+	size := 0
+	for key, value := range metadata {
+		size += len(key) + len(value)
+	}
+	if size > maxMetadataSize {
+		return fmt.Errorf("instance metadata is %d bytes, more than the %d bytes Triton accepts", size, maxMetadataSize)
+	}
+	return nil
+}
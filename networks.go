@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+
+	"github.com/joyent/triton-go/compute"
+	"github.com/joyent/triton-go/network"
+)
+
+// privateCIDRs are the address ranges --triton-use-internal-ip treats as
+// internal (RFC 1918, RFC 6598 shared space and IPv6 unique local)
+var privateCIDRs = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"fc00::/7",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// resolveNetworks maps each network reference (UUID, name, short ID, or
+// "<fabric vlan>/<name>") onto the UUID of exactly one network
+func resolveNetworks(ctx context.Context, nc *network.NetworkClient, refs []string) ([]string, error) {
+	networks, err := nc.List(ctx, &network.ListInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		var match *network.Network
+		if strings.Contains(ref, "/") {
+			match, err = resolveFabricNetwork(ctx, nc, ref)
+		} else {
+			match, err = resolveNetwork(networks, ref)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if seen[match.Id] {
+			log.Warnf("network %q (%s) was requested more than once, ignoring duplicate", ref, match.Id)
+			continue
+		}
+		seen[match.Id] = true
+
+		if match.Id != ref {
+			log.Infof("resolved network %q to %q", ref, match.Id)
+		}
+		ids = append(ids, match.Id)
+	}
+
+	return ids, nil
+}
+
+// resolveNetwork follows the same precedence as image resolution: exact UUID,
+// then exact name, then short ID
+func resolveNetwork(networks []*network.Network, ref string) (*network.Network, error) {
+	nameMatches, shortIdMatches := []*network.Network{}, []*network.Network{}
+	for _, n := range networks {
+		if ref == n.Id {
+			return n, nil
+		}
+		if ref == n.Name {
+			nameMatches = append(nameMatches, n)
+		}
+		if ref == uuidToShortId(n.Id) {
+			shortIdMatches = append(shortIdMatches, n)
+		}
+	}
+
+	switch {
+	case len(nameMatches) == 1:
+		return nameMatches[0], nil
+	case len(nameMatches) > 1:
+		return nil, fmt.Errorf("network name %q is ambiguous, use a UUID or \"<fabric vlan>/<name>\" instead: %s",
+			ref, describeNetworks(nameMatches))
+	case len(shortIdMatches) == 1:
+		return shortIdMatches[0], nil
+	case len(shortIdMatches) > 1:
+		return nil, fmt.Errorf("network short id %q is ambiguous: %s", ref, describeNetworks(shortIdMatches))
+	}
+
+	return nil, fmt.Errorf("no network found matching %q", ref)
+}
+
+// resolveFabricNetwork looks up "<vlan>/<name>", where the VLAN is given by
+// name or numeric ID, among the account's fabric networks
+func resolveFabricNetwork(ctx context.Context, nc *network.NetworkClient, ref string) (*network.Network, error) {
+	vlanName := strings.SplitN(ref, "/", 2)
+	vlanRef, name := vlanName[0], vlanName[1]
+
+	vlans, err := nc.Fabrics().ListVLANs(ctx, &network.ListVLANsInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	vlanMatches := []*network.FabricVLAN{}
+	for _, vlan := range vlans {
+		if vlanRef == vlan.Name || vlanRef == strconv.Itoa(vlan.ID) {
+			vlanMatches = append(vlanMatches, vlan)
+		}
+	}
+	if len(vlanMatches) == 0 {
+		return nil, fmt.Errorf("no fabric VLAN found matching %q", vlanRef)
+	}
+	if len(vlanMatches) > 1 {
+		return nil, fmt.Errorf("fabric VLAN %q is ambiguous, use its numeric ID instead", vlanRef)
+	}
+
+	fabrics, err := nc.Fabrics().List(ctx, &network.ListFabricsInput{
+		FabricVLANID: vlanMatches[0].ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	match, err := resolveNetwork(fabrics, name)
+	if err != nil {
+		return nil, fmt.Errorf("fabric VLAN %q: %s", vlanRef, err)
+	}
+
+	return match, nil
+}
+
+func describeNetworks(networks []*network.Network) string {
+	descriptions := make([]string, 0, len(networks))
+	for _, n := range networks {
+		kind := "public"
+		if n.Fabric {
+			kind = "fabric"
+		} else if !n.Public {
+			kind = "private"
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%s (%s, %s)", n.Id, n.Name, kind))
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// instanceIP picks the address docker-machine should use to reach machine,
+// returning "" if the instance does not (yet) have a matching address
+func (d *Driver) instanceIP(ctx context.Context, c *compute.ComputeClient, machine *compute.Instance) (string, error) {
+	if d.TritonIPNetwork != "" {
+		if _, cidr, err := net.ParseCIDR(d.TritonIPNetwork); err == nil {
+			return firstIPIn(machine.IPs, []*net.IPNet{cidr}), nil
+		}
+
+		// PreCreateCheck resolved anything that is not a CIDR to a network UUID
+		nics, err := c.Instances().ListNICs(ctx, &compute.ListNICsInput{
+			InstanceID: machine.ID,
+		})
+		if err != nil {
+			return "", err
+		}
+		for _, nic := range nics {
+			if nic.Network == d.TritonIPNetwork {
+				return nic.IP, nil
+			}
+		}
+		return "", nil
+	}
+
+	if d.TritonUseInternalIP {
+		return firstIPIn(machine.IPs, privateCIDRs), nil
+	}
+
+	return machine.PrimaryIP, nil
+}
+
+func firstIPIn(ips []string, nets []*net.IPNet) string {
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			continue
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return s
+			}
+		}
+	}
+	return ""
+}
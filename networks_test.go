@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/machine/libmachine/state"
+)
+
+func TestIPNetworkOnlyListsNICsWhenNeeded(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	d := newTestDriver(t, api, testOptions{"ip-network": "Joyent-SDC-Public"})
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatalf("PreCreateCheck: %s", err)
+	}
+	if err := d.Create(); err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	ip := api.machine(d.TritonMachineId).PrimaryIP
+	if d.IPAddress != ip {
+		t.Fatalf("IPAddress = %q, want %q", d.IPAddress, ip)
+	}
+
+	listNICs := "GET /test/machines/" + d.TritonMachineId + "/nics"
+	before := countRequests(api, listNICs)
+	for i := 0; i < 3; i++ {
+		checkState(t, d, state.Running)
+	}
+	if n := countRequests(api, listNICs) - before; n != 0 {
+		t.Errorf("GetState listed NICs %d times", n)
+	}
+
+	// a machine whose address is not known yet, e.g. from an older driver
+	d.IPAddress = ""
+	got, err := d.GetIP()
+	if err != nil {
+		t.Fatalf("GetIP: %s", err)
+	}
+	if got != ip {
+		t.Errorf("GetIP = %q, want %q", got, ip)
+	}
+	if n := countRequests(api, listNICs) - before; n != 1 {
+		t.Errorf("GetIP listed NICs %d times, want 1", n)
+	}
+}
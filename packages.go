@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/joyent/triton-go/client"
+	"github.com/joyent/triton-go/compute"
+)
+
+// tritonPackage is a package as CloudAPI describes it, including the brand
+// compute.Package leaves out. CloudAPI only reports a brand for packages
+// restricted to one.
+type tritonPackage struct {
+	compute.Package
+	Brand string `json:"brand"`
+}
+
+// listPackages lists the account's packages with their brands
+func listPackages(ctx context.Context, c *compute.ComputeClient) ([]*tritonPackage, error) {
+	var packages []*tritonPackage
+	if err := getJSON(ctx, c, fmt.Sprintf("/%s/packages", c.Client.AccountName), &packages); err != nil {
+		return nil, err
+	}
+	return packages, nil
+}
+
+// getPackage looks up a package by name or UUID, with its brand
+func getPackage(ctx context.Context, c *compute.ComputeClient, id string) (*tritonPackage, error) {
+	pkg := &tritonPackage{}
+	if err := getJSON(ctx, c, fmt.Sprintf("/%s/packages/%s", c.Client.AccountName, id), pkg); err != nil {
+		return nil, err
+	}
+	return pkg, nil
+}
+
+// getJSON decodes the response to a GET of path, for the CloudAPI fields the
+// triton-go types lack
+func getJSON(ctx context.Context, c *compute.ComputeClient, path string, v interface{}) error {
+	respReader, err := c.Client.ExecuteRequest(ctx, client.RequestInput{
+		Method: http.MethodGet,
+		Path:   path,
+	})
+	if respReader != nil {
+		defer respReader.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return json.NewDecoder(respReader).Decode(v)
+}
+
+// packageRequirements are the minimum resources asked for with
+// --triton-memory, --triton-vcpus and --triton-disk, plus an exact group and
+// brand
+type packageRequirements struct {
+	Memory int64 // MiB
+	VCPUs  int64
+	Disk   int64 // MiB
+	Group  string
+	Brand  string
+}
+
+func (r packageRequirements) isZero() bool {
+	return r == packageRequirements{}
+}
+
+// matches compares the brand CloudAPI reported for the package, or failing
+// that the brand guessed from its name
+func (r packageRequirements) matches(pkg *tritonPackage) bool {
+	brand, _ := packageBrand(pkg)
+	return pkg.Memory >= r.Memory &&
+		pkg.VCPUs >= r.VCPUs &&
+		pkg.Disk >= r.Disk &&
+		(r.Group == "" || pkg.Group == r.Group) &&
+		(r.Brand == "" || brand == r.Brand)
+}
+
+func (r packageRequirements) String() string {
+	s := fmt.Sprintf("memory >= %d MiB, vcpus >= %d, disk >= %d MiB", r.Memory, r.VCPUs, r.Disk)
+	if r.Group != "" {
+		s += fmt.Sprintf(", group %q", r.Group)
+	}
+	if r.Brand != "" {
+		s += fmt.Sprintf(", brand %s", r.Brand)
+	}
+	return s
+}
+
+// maximum number of alternatives named when a package cannot run the image
+const maxSuggestedPackages = 5
+
+// resolvePackage checks an explicitly named package exists and can run the
+// image, or picks the smallest compatible package meeting the requirements.
+// Ties are broken by vCPUs, disk and then name so the same catalogue always
+// yields the same package.
+func (d *Driver) resolvePackage(ctx context.Context, c *compute.ComputeClient, image *compute.Image) error {
+	if d.TritonPackage != "" {
+		if !d.packageRequirements().isZero() {
+			log.Warnf("--%spackage %q overrides the requested package resources", flagPrefix, d.TritonPackage)
+		}
+
+		// GetPackage (and CreateMachine) both support package names and UUIDs interchangeably
+		pkg, err := getPackage(ctx, c, d.TritonPackage)
+		if err != nil {
+			return err
+		}
+		if err := checkCompatible(image, pkg); err != nil {
+			return suggestPackages(ctx, c, image, pkg, err)
+		}
+		if err := checkBrandGuess(image, pkg); err != nil {
+			log.Warnf("%s; CloudAPI does not report the package's brand, so trying it anyway", err)
+		}
+		return nil
+	}
+
+	requirements := d.packageRequirements()
+	packages, err := listPackages(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	// packages whose name merely suggests the wrong brand are only picked
+	// when nothing else fits
+	matching, candidates, guessedAgainst := 0, []*tritonPackage{}, []*tritonPackage{}
+	for _, pkg := range packages {
+		if !requirements.matches(pkg) {
+			continue
+		}
+		matching++
+		if err := checkCompatible(image, pkg); err != nil {
+			log.Debugf("skipping package %q: %s", pkg.Name, err)
+			continue
+		}
+		if err := checkBrandGuess(image, pkg); err != nil {
+			log.Debugf("avoiding package %q: %s", pkg.Name, err)
+			guessedAgainst = append(guessedAgainst, pkg)
+			continue
+		}
+		candidates = append(candidates, pkg)
+	}
+	if matching == 0 {
+		return fmt.Errorf("no package has %s", requirements)
+	}
+	if len(candidates) == 0 && len(guessedAgainst) > 0 {
+		log.Warnf("none of the packages with %s looks like it can run image %s@%s (%s), but CloudAPI does not report their brands, so trying them anyway",
+			requirements, image.Name, image.Version, image.ID)
+		candidates = guessedAgainst
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("none of the %d packages with %s can run image %s@%s (%s)",
+			matching, requirements, image.Name, image.Version, image.ID)
+	}
+
+	sortPackages(candidates)
+
+	pkg := candidates[0]
+	log.Infof("selected package %q (%s: %d MiB memory, %d vcpus, %d MiB disk) of %d matching %s",
+		pkg.Name, pkg.ID, pkg.Memory, pkg.VCPUs, pkg.Disk, len(candidates), requirements)
+	d.TritonPackage = pkg.ID
+	return nil
+}
+
+func (d *Driver) packageRequirements() packageRequirements {
+	return packageRequirements{
+		Memory: int64(d.TritonMemory),
+		VCPUs:  int64(d.TritonVCPUs),
+		Disk:   int64(d.TritonDisk),
+		Group:  d.TritonPackageGroup,
+		Brand:  d.TritonBrand,
+	}
+}
+
+// suggestPackages turns an incompatibility into an error naming the smallest
+// compatible packages at least as large as the one asked for
+func suggestPackages(ctx context.Context, c *compute.ComputeClient, image *compute.Image, pkg *tritonPackage, reason error) error {
+	packages, err := listPackages(ctx, c)
+	if err != nil {
+		return reason
+	}
+
+	var compatible, larger []*tritonPackage
+	for _, p := range packages {
+		if checkCompatible(image, p) != nil || checkBrandGuess(image, p) != nil {
+			continue
+		}
+		compatible = append(compatible, p)
+		if p.Memory >= pkg.Memory {
+			larger = append(larger, p)
+		}
+	}
+	if len(larger) > 0 {
+		compatible = larger
+	}
+	if len(compatible) == 0 {
+		return fmt.Errorf("%s, and no package can run it", reason)
+	}
+
+	sortPackages(compatible)
+	if len(compatible) > maxSuggestedPackages {
+		compatible = compatible[:maxSuggestedPackages]
+	}
+	names := make([]string, 0, len(compatible))
+	for _, p := range compatible {
+		names = append(names, p.Name)
+	}
+	return fmt.Errorf("%s; compatible packages include %s", reason, strings.Join(names, ", "))
+}
+
+// sortPackages orders packages smallest first
+func sortPackages(packages []*tritonPackage) {
+	sort.Slice(packages, func(i, j int) bool {
+		a, b := packages[i], packages[j]
+		switch {
+		case a.Memory != b.Memory:
+			return a.Memory < b.Memory
+		case a.VCPUs != b.VCPUs:
+			return a.VCPUs < b.VCPUs
+		case a.Disk != b.Disk:
+			return a.Disk < b.Disk
+		}
+		return a.Name < b.Name
+	})
+}
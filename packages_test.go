@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/joyent/triton-go/compute"
+)
+
+func TestResolvePackage(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	// a private cloud naming its packages after neither hypervisor, one of
+	// which CloudAPI reports the brand of
+	api.packages = append(api.packages,
+		&fakePackage{Package: compute.Package{ID: "7a1b2c3d-0000-4000-8000-000000000001", Name: "sample-4G", Memory: 4096, Disk: 51200, VCPUs: 2}},
+		&fakePackage{Package: compute.Package{ID: "7a1b2c3d-0000-4000-8000-000000000002", Name: "sample-8G", Memory: 8192, Disk: 102400, VCPUs: 4}, Brand: "kvm"},
+	)
+	image := api.images[0]
+
+	tests := []struct {
+		name  string
+		flags testOptions
+		want  string
+		err   string
+		warn  string
+	}{
+		{name: "named", flags: testOptions{"package": "k4-highcpu-kvm-1.75G"}, want: "k4-highcpu-kvm-1.75G"},
+		{name: "named zone package", flags: testOptions{"package": "g4-highcpu-1G"}, err: `"g4-highcpu-1G" is a zone package; compatible packages include k4-highcpu-kvm-1.75G`},
+		{name: "named without brand", flags: testOptions{"package": "sample-4G"}, want: "sample-4G", warn: `"sample-4G" looks like a zone package`},
+		{name: "named with brand", flags: testOptions{"package": "sample-8G"}, want: "sample-8G"},
+		{name: "too small", flags: testOptions{"package": "k4-highcpu-kvm-250M"}, err: "needs at least 1024 MiB"},
+		{name: "by memory", flags: testOptions{"package": "", "memory": 2048}, want: "b1-standard-bhyve-4G"},
+		{name: "by brand", flags: testOptions{"package": "", "brand": "kvm", "memory": 4096}, want: "sample-8G"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newTestDriver(t, api, test.flags)
+			c, err := d.client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			history := len(log.History())
+
+			err = d.resolvePackage(context.Background(), c, image)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("resolvePackage = %v, want an error containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolvePackage: %s", err)
+			}
+
+			got := d.TritonPackage
+			for _, pkg := range api.packages {
+				if pkg.ID == got {
+					got = pkg.Name
+				}
+			}
+			if got != test.want {
+				t.Errorf("resolved package %s, want %s", got, test.want)
+			}
+
+			warned := strings.Join(log.History()[history:], "\n")
+			if test.warn != "" && !strings.Contains(warned, test.warn) {
+				t.Errorf("no warning containing %q in %q", test.warn, warned)
+			}
+		})
+	}
+}
+
+func TestResolvePackageGuessedOnly(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	api.packages = []*fakePackage{
+		{Package: compute.Package{ID: "7a1b2c3d-0000-4000-8000-000000000001", Name: "sample-4G", Memory: 4096, Disk: 51200, VCPUs: 2}},
+	}
+	d := newTestDriver(t, api, testOptions{"package": "", "memory": 2048})
+	c, err := d.client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is known to be incompatible, so the guess does not rule the
+	// package out
+	if err := d.resolvePackage(context.Background(), c, api.images[0]); err != nil {
+		t.Fatalf("resolvePackage: %s", err)
+	}
+	if d.TritonPackage != api.packages[0].ID {
+		t.Errorf("resolved package %s, want %s", d.TritonPackage, api.packages[0].ID)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/joyent/triton-go/compute"
+)
+
+// affinity rules are "<key><op><value>", where key is "instance",
+// "container" or a tag name, op is one of ==, !=, ==~ (soft) or !=~ (soft),
+// and value is an exact string, a glob or a /regex/
+//
+// https://apidocs.joyent.com/cloudapi/#affinity-rules
+var affinityPattern = regexp.MustCompile(`^([^\s=!~]+)\s*(==~|!=~|==|!=)\s*(\S.*)$`)
+
+func checkAffinityRules(rules []string) error {
+	for _, rule := range rules {
+		if !affinityPattern.MatchString(rule) {
+			return fmt.Errorf("invalid affinity rule %q, expected e.g. \"instance!=~swarm-mgr*\" or \"role==manager\"", rule)
+		}
+	}
+	return nil
+}
+
+// checkPlacement validates the placement options together; CloudAPI takes
+// either affinity rules or locality hints, never both
+func (d *Driver) checkPlacement() error {
+	if err := checkAffinityRules(d.TritonAffinity); err != nil {
+		return err
+	}
+
+	hasLocality := len(d.TritonLocalityNear) > 0 || len(d.TritonLocalityFar) > 0
+	if len(d.TritonAffinity) > 0 && hasLocality {
+		return fmt.Errorf("%s driver accepts either --%saffinity or --%slocality-near/--%slocality-far, not both",
+			driverName, flagPrefix, flagPrefix, flagPrefix)
+	}
+	if d.TritonLocalityStrict && !hasLocality {
+		return fmt.Errorf("%s driver requires --%slocality-near or --%slocality-far with --%slocality-strict",
+			driverName, flagPrefix, flagPrefix, flagPrefix)
+	}
+	return nil
+}
+
+// resolveInstances maps each instance reference (UUID, name or short ID)
+// onto an instance UUID, as locality hints only take UUIDs
+func resolveInstances(ctx context.Context, c *compute.ComputeClient, refs []string) ([]string, error) {
+	if len(refs) == 0 {
+		return refs, nil
+	}
+
+	instances, err := c.Instances().List(ctx, &compute.ListInstancesInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		match, err := resolveInstance(instances, ref)
+		if err != nil {
+			return nil, err
+		}
+		if match.ID != ref {
+			log.Infof("resolved instance %q to %q", ref, match.ID)
+		}
+		ids = append(ids, match.ID)
+	}
+	return ids, nil
+}
+
+// resolveInstance follows the same precedence as image and network
+// resolution: exact UUID, then exact name, then short ID
+func resolveInstance(instances []*compute.Instance, ref string) (*compute.Instance, error) {
+	var shortIdMatches []*compute.Instance
+	for _, instance := range instances {
+		if ref == instance.ID || ref == instance.Name {
+			return instance, nil
+		}
+		if ref == uuidToShortId(instance.ID) {
+			shortIdMatches = append(shortIdMatches, instance)
+		}
+	}
+
+	switch len(shortIdMatches) {
+	case 0:
+		return nil, fmt.Errorf("no instance found matching %q", ref)
+	case 1:
+		return shortIdMatches[0], nil
+	}
+	return nil, fmt.Errorf("instance short id %q is ambiguous, use a name or UUID instead", ref)
+}
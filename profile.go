@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnutils"
+)
+
+// tritonProfile is the subset of a node-triton CLI profile used by the driver
+//
+// https://github.com/joyent/node-triton#configuration
+type tritonProfile struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Account  string `json:"account"`
+	KeyID    string `json:"keyId"`
+	Insecure bool   `json:"insecure"`
+}
+
+// tritonConfig is ~/.triton/config.json
+type tritonConfig struct {
+	Profile  string `json:"profile"`
+	Profiles struct {
+		Defaults tritonProfile `json:"defaults"`
+	} `json:"profiles"`
+}
+
+func tritonConfigDir() string {
+	return filepath.Join(mcnutils.GetHomeDir(), ".triton")
+}
+
+// legacyProfileEnv are the SDC_ variables that configure what a profile does
+var legacyProfileEnv = []string{legacyEnvPrefix + "URL", legacyEnvPrefix + "ACCOUNT", legacyEnvPrefix + "KEY_ID"}
+
+// loadProfile reads the named node-triton profile on top of the defaults in
+// config.json. An empty name selects the CLI's current profile, unless the
+// SDC_ variables are set: they predate profiles, and scripts setting them
+// expect them to be used. nil is returned when no profile is selected, the
+// "env" profile is, or the current profile does not exist.
+func loadProfile(name string) (*tritonProfile, error) {
+	config := &tritonConfig{}
+	if err := readJSONFile(filepath.Join(tritonConfigDir(), "config.json"), config); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading triton config: %s", err)
+	}
+
+	current := name == ""
+	if current {
+		for _, env := range legacyProfileEnv {
+			if os.Getenv(env) != "" {
+				log.Debugf("%s is set, so not using the current triton profile", env)
+				return nil, nil
+			}
+		}
+		name = config.Profile
+	}
+	if name == "" || name == "env" {
+		return nil, nil
+	}
+
+	profile := config.Profiles.Defaults
+	path := filepath.Join(tritonConfigDir(), "profiles.d", name+".json")
+	if err := readJSONFile(path, &profile); err != nil {
+		if os.IsNotExist(err) {
+			if current {
+				log.Warnf("not using the current triton profile %q: %s does not exist", name, path)
+				return nil, nil
+			}
+			return nil, fmt.Errorf("no such triton profile %q (expected %s)", name, path)
+		}
+		return nil, fmt.Errorf("error reading triton profile %q: %s", name, err)
+	}
+
+	return &profile, nil
+}
+
+func readJSONFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// getEnv looks up a variable with the TRITON_ prefix, falling back to the
+// legacy SDC_ prefix
+func getEnv(name string) string {
+	if value := os.Getenv(envPrefix + name); value != "" {
+		return value
+	}
+	return os.Getenv(legacyEnvPrefix + name)
+}
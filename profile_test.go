@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTritonConfig(t *testing.T, current string, profiles ...string) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dir := filepath.Join(home, ".triton", "profiles.d")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	config := `{"profile": "` + current + `"}`
+	if err := ioutil.WriteFile(filepath.Join(home, ".triton", "config.json"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range profiles {
+		profile := `{"url": "https://` + name + `.example.com", "account": "` + name + `"}`
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".json"), []byte(profile), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  string
+		profiles []string
+		env      map[string]string
+		profile  string
+		want     string
+		err      bool
+	}{
+		{name: "current", current: "east", profiles: []string{"east"}, want: "east"},
+		{name: "named", current: "east", profiles: []string{"east", "west"}, profile: "west", want: "west"},
+		{name: "none", profiles: []string{"east"}},
+		{name: "env", current: "env", profiles: []string{"east"}},
+		{name: "current missing", current: "gone", profiles: []string{"east"}},
+		{name: "named missing", current: "east", profiles: []string{"east"}, profile: "gone", err: true},
+		{name: "current under SDC_URL", current: "east", profiles: []string{"east"}, env: map[string]string{"SDC_URL": "https://sdc.example.com"}},
+		{name: "current under SDC_ACCOUNT", current: "east", profiles: []string{"east"}, env: map[string]string{"SDC_ACCOUNT": "sdc"}},
+		{name: "named under SDC_ACCOUNT", current: "east", profiles: []string{"east", "west"}, env: map[string]string{"SDC_ACCOUNT": "sdc"}, profile: "west", want: "west"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writeTritonConfig(t, test.current, test.profiles...)
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			profile, err := loadProfile(test.profile)
+			if test.err {
+				if err == nil {
+					t.Fatalf("loadProfile(%q) = %+v, want an error", test.profile, profile)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadProfile(%q): %s", test.profile, err)
+			}
+
+			got := ""
+			if profile != nil {
+				got = profile.Account
+			}
+			if got != test.want {
+				t.Errorf("loadProfile(%q) loaded %q, want %q", test.profile, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLegacyEnvOverridesCurrentProfile(t *testing.T) {
+	writeTritonConfig(t, "east", "east")
+	t.Setenv("SDC_URL", "https://sdc.example.com")
+	t.Setenv("SDC_ACCOUNT", "sdc")
+
+	driver := NewDriver("test-machine", t.TempDir())
+	d := &driver
+	opts := createFlagDefaults(d)
+	opts[flagPrefix+"account"] = ""
+	if err := d.SetConfigFromFlags(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.TritonUrl != "https://sdc.example.com" || d.TritonAccount != "sdc" {
+		t.Errorf("configured %s at %s, want the SDC_ settings", d.TritonAccount, d.TritonUrl)
+	}
+}
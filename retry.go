@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/hashicorp/errwrap"
+	"github.com/joyent/triton-go/client"
+	"github.com/joyent/triton-go/compute"
+)
+
+var (
+	// CloudAPI attempts per call, and the cap on the backoff between them in
+	// seconds
+	defaultTritonAPIMaxAttempts = 5
+	defaultTritonAPIMaxBackoff  = 30
+
+	retryInitialBackoff = 1 * time.Second
+
+	jitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// apiResponses remembers the status and Retry-After of the most recent
+// CloudAPI response. triton-go drops both when it turns a response into an
+// error, e.g. a 502 from a proxy whose body isn't a CloudAPI error.
+type apiResponses struct {
+	mu         sync.Mutex
+	status     int
+	retryAfter time.Duration
+}
+
+func (r *apiResponses) record(resp *http.Response) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.status = resp.StatusCode
+	r.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+}
+
+func (r *apiResponses) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.status, r.retryAfter = 0, 0
+}
+
+// last returns the most recent response's status and Retry-After since the
+// last reset
+func (r *apiResponses) last() (int, time.Duration) {
+	if r == nil {
+		return 0, 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.status, r.retryAfter
+}
+
+// Retry-After is either a number of seconds or an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(time.Now()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+type recordingTransport struct {
+	base      http.RoundTripper
+	responses *apiResponses
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		t.responses.record(resp)
+	}
+	return resp, err
+}
+
+// recordResponses wraps base so that it reports responses to the driver's
+// retry logic
+func (d *Driver) recordResponses(base http.RoundTripper) http.RoundTripper {
+	if d.responses == nil {
+		d.responses = &apiResponses{}
+	}
+	return &recordingTransport{base: base, responses: d.responses}
+}
+
+// retryableError marks a failure the caller has made safe to repeat
+type retryableError struct {
+	error
+}
+
+// isThrottled reports whether CloudAPI turned the request away before acting
+// on it, which makes even non-idempotent calls safe to repeat
+func isThrottled(err error, status int) bool {
+	return compute.IsRequestThrottled(err) || status == http.StatusTooManyRequests
+}
+
+// isTransient reports whether a call failed in a way that may succeed if
+// repeated: throttling, server errors and broken connections
+func isTransient(err error, status int) bool {
+	if _, ok := err.(retryableError); ok {
+		return true
+	}
+	if isThrottled(err, status) || compute.IsInternalError(err) || status >= http.StatusInternalServerError {
+		return true
+	}
+	if tritonErr, ok := errwrap.GetType(err, &client.TritonError{}).(*client.TritonError); ok && tritonErr.StatusCode >= http.StatusInternalServerError {
+		return true
+	}
+	if urlErr, ok := errwrap.GetType(err, &url.Error{}).(*url.Error); ok {
+		// includes requests that hit --triton-api-timeout
+		return urlErr.Err != context.Canceled
+	}
+	return false
+}
+
+// retry calls fn until it succeeds, fails permanently or runs out of
+// attempts. Calls that are not idempotent are only repeated when CloudAPI
+// throttled them, as any other failure may have happened after the change
+// was made.
+func (d *Driver) retry(ctx context.Context, action string, idempotent bool, fn func() error) error {
+	maxAttempts := d.TritonAPIMaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultTritonAPIMaxAttempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.responses != nil {
+			d.responses.reset()
+		}
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		status, retryAfter := d.responses.last()
+		if attempt >= maxAttempts || !isTransient(err, status) || (!idempotent && !isThrottled(err, status)) {
+			if r, ok := err.(retryableError); ok {
+				return r.error
+			}
+			return err
+		}
+
+		delay := d.backoff(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		log.Debugf("%s failed (attempt %d of %d), retrying in %s: %s", action, attempt, maxAttempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff doubles with every attempt up to the configured cap, and picks a
+// random delay in the upper half so parallel creates spread out
+func (d *Driver) backoff(attempt int) time.Duration {
+	maxBackoff := time.Duration(d.TritonAPIMaxBackoff) * time.Second
+	if maxBackoff <= 0 {
+		maxBackoff = time.Duration(defaultTritonAPIMaxBackoff) * time.Second
+	}
+
+	delay := retryInitialBackoff << uint(attempt-1)
+	if delay > maxBackoff || delay <= 0 {
+		delay = maxBackoff
+	}
+	return delay/2 + time.Duration(jitter.Int63n(int64(delay/2)+1))
+}
+
+// createInstance creates the instance. Failures that leave it unclear whether
+// CloudAPI acted are only retried once listing instances shows it did not;
+// an instance with the machine's name and tags is adopted instead of creating
+// another.
+func (d *Driver) createInstance(ctx context.Context, c *compute.ComputeClient, input *compute.CreateInstanceInput) (*compute.Instance, error) {
+	var machine *compute.Instance
+	err := d.retry(ctx, "create instance", true, func() error {
+		var err error
+		machine, err = c.Instances().Create(ctx, input)
+		if err == nil {
+			return nil
+		}
+		status, _ := d.responses.last()
+		if isThrottled(err, status) || !isTransient(err, status) {
+			return err
+		}
+
+		var existing []*compute.Instance
+		listErr := d.retry(ctx, "list instances", true, func() error {
+			var err error
+			existing, err = c.Instances().List(ctx, &compute.ListInstancesInput{
+				Name: input.Name,
+			})
+			return err
+		})
+		if listErr != nil {
+			return fmt.Errorf("%s (and could not check whether the instance was created: %s)", err, listErr)
+		}
+
+		for _, instance := range existing {
+			// the tags tell this machine's instance from an unrelated one
+			// that happens to share its name
+			if instance.Name == input.Name &&
+				instance.Tags[machineNameTag] == d.MachineName &&
+				instance.Tags[machineDriverTag] == driverName {
+				log.Infof("instance %s was created despite the error: %s", instance.ID, err)
+				machine = instance
+				return nil
+			}
+		}
+		return retryableError{err}
+	})
+	return machine, err
+}
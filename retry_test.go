@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// resetConnection drops the connection without answering, as a crashed proxy
+// or a network failure would
+func resetConnection(t *testing.T, w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	conn.Close()
+}
+
+// failOnce makes the first request matching method and path suffix fail
+// with fail, which may first pass it on to api
+func failOnce(api *fakeCloudAPI, method, suffix string, fail func(w http.ResponseWriter, r *http.Request)) {
+	var mu sync.Mutex
+	failed := false
+	api.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		mu.Lock()
+		if failed || r.Method != method || !strings.HasSuffix(r.URL.Path, suffix) {
+			mu.Unlock()
+			return false
+		}
+		failed = true
+		mu.Unlock()
+		fail(w, r)
+		return true
+	})
+}
+
+func TestPingRetried(t *testing.T) {
+	for name, fail := range map[string]func(t *testing.T) func(w http.ResponseWriter, r *http.Request){
+		"reset": func(t *testing.T) func(w http.ResponseWriter, r *http.Request) {
+			return func(w http.ResponseWriter, r *http.Request) { resetConnection(t, w) }
+		},
+		"unavailable": func(t *testing.T) func(w http.ResponseWriter, r *http.Request) {
+			return func(w http.ResponseWriter, r *http.Request) {
+				writeError(w, http.StatusServiceUnavailable, "ServiceUnavailable", "try again")
+			}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := newFakeCloudAPI(t)
+			d := newTestDriver(t, api, nil)
+			failOnce(api, http.MethodGet, "/--ping", fail(t))
+
+			if err := d.PreCreateCheck(); err != nil {
+				t.Fatalf("PreCreateCheck: %s", err)
+			}
+			if n := countRequests(api, "GET /--ping"); n != 2 {
+				t.Errorf("pinged %d times, want 2", n)
+			}
+		})
+	}
+}
+
+func TestPingNotFound(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	d := newTestDriver(t, api, nil)
+	api.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/--ping" {
+			return false
+		}
+		writeError(w, http.StatusNotFound, "ResourceNotFound", "not CloudAPI")
+		return true
+	})
+
+	if err := d.PreCreateCheck(); err == nil {
+		t.Fatal("PreCreateCheck succeeded against an endpoint without /--ping")
+	}
+	if n := countRequests(api, "GET /--ping"); n != 1 {
+		t.Errorf("pinged %d times, want 1", n)
+	}
+}
+
+func TestDeleteRetried(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	d := newTestDriver(t, api, nil)
+	d.TritonMachineId = api.addMachine("test-machine", nil).ID
+	failOnce(api, http.MethodDelete, "/machines/"+d.TritonMachineId, func(w http.ResponseWriter, r *http.Request) {
+		resetConnection(t, w)
+	})
+
+	if err := d.Remove(); err != nil {
+		t.Fatalf("Remove: %s", err)
+	}
+	if m := api.machine(d.TritonMachineId); m.State != "deleted" {
+		t.Errorf("instance is %s after Remove", m.State)
+	}
+	if n := countRequests(api, "DELETE /test/machines/"+d.TritonMachineId); n != 2 {
+		t.Errorf("deleted %d times, want 2", n)
+	}
+}
+
+func TestCreateAdoptsInstanceCreatedDespiteError(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	d := newTestDriver(t, api, nil)
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatalf("PreCreateCheck: %s", err)
+	}
+
+	// CloudAPI creates the instance, but the response is lost
+	failOnce(api, http.MethodPost, "/test/machines", func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		api.createMachine(httptest.NewRecorder(), r)
+		api.mu.Unlock()
+		resetConnection(t, w)
+	})
+
+	if err := d.Create(); err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	if n := countRequests(api, "POST /test/machines"); n != 1 {
+		t.Errorf("created %d times, want 1", n)
+	}
+	if m := api.machine(d.TritonMachineId); m == nil || m.Name != "test-machine" {
+		t.Errorf("adopted %+v", m)
+	}
+}
+
+func TestCreateIgnoresUnrelatedInstance(t *testing.T) {
+	api := newFakeCloudAPI(t)
+	// adopting the instance would wait for it to get an IP
+	d := newTestDriver(t, api, testOptions{"provision-timeout": 1})
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatalf("PreCreateCheck: %s", err)
+	}
+
+	// someone else's instance of the same name, and a create that fails
+	// before CloudAPI acts on it
+	other := api.addMachine("test-machine", map[string]interface{}{"role": "db"})
+	failOnce(api, http.MethodPost, "/test/machines", func(w http.ResponseWriter, r *http.Request) {
+		resetConnection(t, w)
+	})
+
+	err := d.Create()
+	if err == nil {
+		t.Fatal("Create succeeded despite the name being taken")
+	}
+	if d.TritonMachineId == other.ID {
+		t.Errorf("adopted unrelated instance %s", other.ID)
+	}
+	if n := countRequests(api, "POST /test/machines"); n != 2 {
+		t.Errorf("created %d times, want 2", n)
+	}
+}
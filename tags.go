@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/joyent/triton-go/client"
+	"github.com/joyent/triton-go/compute"
+)
+
+const (
+	machineNameTag   = "docker-machine.name"
+	machineDriverTag = "docker-machine.driver"
+
+	// tag namespace Triton keeps for itself (CNS, etc.)
+	reservedTagPrefix = "triton."
+)
+
+// parseTags reads KEY=VALUE tags, typing "true"/"false" as booleans and
+// anything numeric as a number the way the triton CLI does
+func parseTags(pairs []string) (map[string]interface{}, error) {
+	tags := map[string]interface{}{}
+	for _, pair := range pairs {
+		key, value, err := parseKeyValue("tags", pair)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(key, reservedTagPrefix) {
+			return nil, fmt.Errorf("tag %q is reserved: %q tags are managed by Triton", key, reservedTagPrefix)
+		}
+		if key == machineNameTag || key == machineDriverTag {
+			return nil, fmt.Errorf("tag %q is set by docker-machine", key)
+		}
+		tags[key] = parseTagValue(value)
+	}
+	return tags, nil
+}
+
+func parseTagValue(value string) interface{} {
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	// JSON has no NaN or Inf, so those stay strings
+	if n, err := strconv.ParseFloat(value, 64); err == nil && !math.IsNaN(n) && !math.IsInf(n, 0) {
+		return n
+	}
+	return value
+}
+
+// instanceTags is the full set of tags this machine should carry
+func (d *Driver) instanceTags() map[string]interface{} {
+	tags := map[string]interface{}{}
+	for key, value := range d.TritonTags {
+		tags[key] = value
+	}
+	tags[machineNameTag] = d.MachineName
+	tags[machineDriverTag] = driverName
+	return tags
+}
+
+// stringTags formats tags for CreateInstanceInput, which only takes strings;
+// syncTags restores the typed values once the instance exists
+func stringTags(tags map[string]interface{}) map[string]string {
+	result := make(map[string]string, len(tags))
+	for key, value := range tags {
+		switch v := value.(type) {
+		case float64:
+			result[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			result[key] = fmt.Sprint(v)
+		}
+	}
+	return result
+}
+
+// syncTags adds any of the machine's tags that are missing or differ on the
+// instance. Tags added outside docker-machine are left alone.
+func (d *Driver) syncTags(ctx context.Context, c *compute.ComputeClient, machine *compute.Instance) error {
+	changed := map[string]interface{}{}
+	for key, value := range d.instanceTags() {
+		if current, ok := machine.Tags[key]; !ok || current != value {
+			changed[key] = value
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	log.Debugf("updating tags on instance %s: %v", machine.ID, changed)
+
+	// Instances().AddTags only sends strings, so post typed values directly
+	input := client.RequestInput{
+		Method: http.MethodPost,
+		Path:   fmt.Sprintf("/%s/machines/%s/tags", c.Client.AccountName, machine.ID),
+		Body:   changed,
+	}
+	err := d.retry(ctx, "update tags", true, func() error {
+		respReader, err := c.Client.ExecuteRequest(ctx, input)
+		if respReader != nil {
+			respReader.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error updating tags on instance %s: %s", machine.ID, err)
+	}
+	return nil
+}
+
+// restoreTags re-applies the machine's tags, e.g. after someone edited them in
+// the portal. Failures are only logged: tags never stop a host from working.
+func (d *Driver) restoreTags(ctx context.Context, c *compute.ComputeClient) {
+	var machine *compute.Instance
+	err := d.retry(ctx, "get instance", true, func() error {
+		var err error
+		machine, err = getInstance(ctx, c, d.TritonMachineId)
+		return err
+	})
+	if err == nil {
+		err = d.syncTags(ctx, c, machine)
+	}
+	if err != nil {
+		log.Warnf("could not update tags on instance %s: %s", d.TritonMachineId, err)
+	}
+}
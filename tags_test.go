@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tags, err := parseTags([]string{
+		"role=web",
+		"enabled=true",
+		"debug=false",
+		"weight=10",
+		"ratio=0.5",
+		"nan=NaN",
+		"inf=Inf",
+		"negative-inf=-Infinity",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"role":         "web",
+		"enabled":      true,
+		"debug":        false,
+		"weight":       float64(10),
+		"ratio":        0.5,
+		"nan":          "NaN",
+		"inf":          "Inf",
+		"negative-inf": "-Infinity",
+	}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("parseTags = %v, want %v", tags, want)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// legacyInsecureEnv are the node-triton variables that also turn off TLS
+// verification, besides TRITON_TLS_INSECURE
+var legacyInsecureEnv = []string{legacyEnvPrefix + "TLS_INSECURE", legacyEnvPrefix + "TESTING"}
+
+// envInsecure reports whether one of legacyInsecureEnv asks to skip TLS
+// verification
+func envInsecure() (bool, error) {
+	for _, name := range legacyInsecureEnv {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		insecure, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, fmt.Errorf("invalid %s %q: expected true or false", name, value)
+		}
+		if insecure {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// loadCACerts adds the PEM certificates in path, a file or a directory of
+// files, to the system roots
+func loadCACerts(path string) (*x509.CertPool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error locating CA certificates from %s: %s", path, err)
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA certificates from %s: %s", path, err)
+		}
+		files = files[:0]
+		for _, entry := range entries {
+			file := filepath.Join(path, entry.Name())
+			// follow the symlinks of c_rehash style directories
+			if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+				files = append(files, file)
+			}
+		}
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	found := false
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA certificate %s: %s", file, err)
+		}
+		if pool.AppendCertsFromPEM(data) {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// tlsConfig is used for every connection the driver makes to CloudAPI
+func (d *Driver) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: d.TritonInsecure,
+	}
+	if d.TritonCACert != "" {
+		pool, err := loadCACerts(d.TritonCACert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}